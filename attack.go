@@ -0,0 +1,218 @@
+// Attack module. This simulates adversarial behavior targeting the estimator,
+// so that its resistance to manipulation can be verified.
+//
+// The attacks currently simulated are:
+//
+// - Fee inflation: a miner that, right before mining each of its blocks,
+// broadcasts txs paying a very high fee rate back to itself and mines them. If
+// the estimator took these into account, it would suggest higher fees.
+//
+// - Spam: an attacker that floods the network with txs paying a low fee rate
+// (usually the minimum relay fee), competing for block space with the honest
+// txs and filling the lowest fee buckets of the estimator.
+//
+// - Tx hiding: sybil nodes surrounding the node running the estimator, which
+// don't relay some of the txs to it. Miners still receive and mine the hidden
+// txs.
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+)
+
+// attackKind is the kind of attack performed by a simulated attacker.
+type attackKind int
+
+const (
+	attackFeeInflation attackKind = iota
+	attackSpam
+	attackHideTxs
+
+	numAttackKinds
+)
+
+var attackKindNames = [numAttackKinds]string{
+	attackFeeInflation: "feeInflation",
+	attackSpam:         "spam",
+	attackHideTxs:      "hideTxs",
+}
+
+func (k attackKind) String() string {
+	return attackKindNames[k]
+}
+
+// attackerConfig configures one of the attackers of a test case.
+type attackerConfig struct {
+	kind attackKind
+
+	// miner is the name of the miner (of the simulated miner population)
+	// performing a fee inflation attack
+	miner string
+
+	// txsPerBlock is the number of txs created by the attacker on each block
+	// (for fee inflation and spam attacks)
+	txsPerBlock int
+
+	// txSize is the size (in bytes) of the txs created by the attacker. If
+	// zero, the smallest size of generated txs is used.
+	txSize uint32
+
+	// feeRate is the fee rate (in atoms/KB) paid by the txs created by the
+	// attacker. For spam attacks, the minimum fee rate of generated txs is
+	// used if zero.
+	feeRate uint32
+
+	// hiddenFraction is the fraction of the txs not relayed to the node running
+	// the estimator (for tx hiding attacks)
+	hiddenFraction float64
+
+	// hideMaxFeeRate is the maximum fee rate (in atoms/KB) of the txs not
+	// relayed to the node running the estimator. If zero, txs are hidden
+	// regardless of their fee rate.
+	hideMaxFeeRate uint32
+}
+
+// attackStats tracks the txs created and hidden by attackers.
+type attackStats struct {
+	inflationTxs      int
+	inflationTxsMined int
+	spamTxs           int
+	spamTxsMined      int
+	hiddenTxs         int
+}
+
+// newAttackTx returns a new tx created by an attacker.
+func newAttackTx(cfg *attackerConfig, feeRate, height uint32, idx int) *simTx {
+	size := cfg.txSize
+	if size == 0 {
+		size = minSimTxSize
+	}
+	tx := &simTx{
+		size:      size,
+		feeRate:   feeRate,
+		fee:       feeRate * size / 1000,
+		genHeight: height,
+		attacker:  cfg,
+	}
+	tx.setMsgTx(idx)
+	return tx
+}
+
+// genFeeInflationTxs creates the txs broadcast by a fee inflation attacker
+// right before mining the block at the given height, in case the attacker is
+// the selected miner. The txs are added to the mempool, so that the miner can
+// include them in its block.
+func (sim *simulator) genFeeInflationTxs(currentHeight uint32, minerIdx int, memPool *txPool) []*simTx {
+	var txs []*simTx
+	for i := range sim.cfg.attackers {
+		cfg := &sim.cfg.attackers[i]
+		if cfg.kind != attackFeeInflation ||
+			cfg.miner != sim.miners[minerIdx].name {
+			continue
+		}
+
+		for j := 0; j < cfg.txsPerBlock; j++ {
+			// The txs are broadcast while the previous block is still the
+			// tip of the chain
+			tx := newAttackTx(cfg, cfg.feeRate, currentHeight-1, len(txs))
+			heap.Push(memPool, tx)
+			sim.memPoolSize += uint64(tx.size)
+			txs = append(txs, tx)
+		}
+	}
+	sim.attackStats.inflationTxs += len(txs)
+	return txs
+}
+
+// genSpamTxs creates the txs broadcast by spam attackers after the block at
+// the given height has been mined and adds them to the mempool.
+func (sim *simulator) genSpamTxs(currentHeight uint32, memPool *txPool) []*simTx {
+	var txs []*simTx
+	for i := range sim.cfg.attackers {
+		cfg := &sim.cfg.attackers[i]
+		if cfg.kind != attackSpam {
+			continue
+		}
+
+		rate := cfg.feeRate
+		if rate == 0 {
+			rate = sim.cfg.minimumFeeRate
+		}
+		for j := 0; j < cfg.txsPerBlock; j++ {
+			tx := newAttackTx(cfg, rate, currentHeight, len(txs))
+			heap.Push(memPool, tx)
+			sim.memPoolSize += uint64(tx.size)
+			txs = append(txs, tx)
+		}
+	}
+	sim.attackStats.spamTxs += len(txs)
+	return txs
+}
+
+// hideTx returns whether a newly generated tx is hidden from the node running
+// the estimator by a tx hiding attacker.
+func (sim *simulator) hideTx(tx *simTx) bool {
+	for i := range sim.cfg.attackers {
+		cfg := &sim.cfg.attackers[i]
+		if cfg.kind != attackHideTxs {
+			continue
+		}
+		if cfg.hideMaxFeeRate > 0 && tx.feeRate > cfg.hideMaxFeeRate {
+			continue
+		}
+		if sim.rnd.Float64() < cfg.hiddenFraction {
+			sim.attackStats.hiddenTxs++
+			return true
+		}
+	}
+	return false
+}
+
+// trackMinedAttackTxs updates the attack stats with the attacker txs included
+// in a block.
+func (sim *simulator) trackMinedAttackTxs(mined []*simTx) {
+	for _, tx := range mined {
+		if tx.attacker == nil {
+			continue
+		}
+		switch tx.attacker.kind {
+		case attackFeeInflation:
+			sim.attackStats.inflationTxsMined++
+		case attackSpam:
+			sim.attackStats.spamTxsMined++
+		}
+	}
+}
+
+// reportAttacks prints the stats for the simulated attacks.
+func (sim *simulator) reportAttacks(w io.Writer) {
+	stats := &sim.attackStats
+	fmt.Fprintf(w, "Attacks\n")
+	fmt.Fprintf(w, "  fee inflation txs = %d (mined = %d)  spam txs = %d (mined "+
+		"= %d)  hidden txs = %d\n", stats.inflationTxs,
+		stats.inflationTxsMined, stats.spamTxs, stats.spamTxsMined,
+		stats.hiddenTxs)
+}
+
+// reportAttackImpact prints the estimates of the attacked estimator next to the
+// ones of a reference estimator which only saw honest traffic.
+func reportAttackImpact(w io.Writer, attacked, reference *FeeEstimator,
+	targets []int32, successPct float64) {
+
+	fmt.Fprintf(w, "%8s%12s%12s %10s\n", "target", "attacked", "reference",
+		"delta%")
+	for _, t := range targets {
+		attackedFee, attackedErr := attacked.estimateMedianFee(t, successPct)
+		refFee, refErr := reference.estimateMedianFee(t, successPct)
+		delta := fmt.Sprintf("%10s", "-")
+		if attackedErr == nil && refErr == nil && refFee > 0 {
+			delta = fmt.Sprintf("%10.2f", float64(attackedFee-refFee)*100/
+				float64(refFee))
+		}
+		fmt.Fprintf(w, "%8d%s%s %s\n", t, formatEstimate(attackedFee, attackedErr),
+			formatEstimate(refFee, refErr), delta)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,84 @@
+// Check module. This runs the simulation of a test case while verifying, after
+// every block, that the incrementally maintained mempool stats of the
+// estimators match the ones recomputed from their tracked mempool txs.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// memPoolCheckTolerance is the relative tolerance used when comparing the
+	// mempool stats of an estimator with the recomputed ones
+	memPoolCheckTolerance = 1e-6
+
+	// maxReportedCheckFailures is the maximum number of failed checks
+	// described in the report
+	maxReportedCheckFailures = 10
+)
+
+// memPoolChecks tracks the results of the checks of the mempool stats made
+// during a simulation.
+type memPoolChecks struct {
+	checked  int
+	failed   int
+	failures []string
+}
+
+// check checks the mempool stats of an estimator after the block at the given
+// height, repairing them if they don't match so that a single bug doesn't fail
+// every subsequent check.
+func (mc *memPoolChecks) check(h uint32, name string, estimator *FeeEstimator) {
+	mc.checked++
+	err := estimator.CheckMemPool(memPoolCheckTolerance, true)
+	if err == nil {
+		return
+	}
+	mc.failed++
+	if len(mc.failures) < maxReportedCheckFailures {
+		mc.failures = append(mc.failures, fmt.Sprintf("block %d (%s "+
+			"estimator): %v", h, name, err))
+	}
+}
+
+// reportMemPoolChecks prints the results of the checks of the mempool stats.
+func (run *simRun) reportMemPoolChecks(w io.Writer) {
+	mc := run.memPoolChecks
+	fmt.Fprintf(w, "Checked the mempool stats %d times, %d failed\n", mc.checked,
+		mc.failed)
+	for _, f := range mc.failures {
+		fmt.Fprintf(w, "  %s\n", f)
+	}
+	if mc.failed > len(mc.failures) {
+		fmt.Fprintf(w, "  (%d more)\n", mc.failed-len(mc.failures))
+	}
+}
+
+// checkMain is the entry point of the check command, which simulates the test
+// case given as its argument checking the mempool stats of the estimators after
+// every block. Exits with a non-zero code if any of the checks fails.
+func checkMain(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Please specify the test number")
+		os.Exit(1)
+	}
+	tc, err := parseTestCase(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	run := runSimulation(tc, defaultSeed, true, func(pct uint32) {
+		fmt.Fprintf(os.Stderr, "%d%% ", pct)
+	})
+	fmt.Fprintf(os.Stderr, "\n\n")
+	fmt.Fprintf(os.Stderr, "Total time: %s\n", run.duration.String())
+
+	fmt.Println("=== Mempool stats checks ===")
+	run.reportMemPoolChecks(os.Stdout)
+	if run.memPoolChecks.failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"math"
-	"os"
 	"sort"
 
 	"github.com/decred/dcrd/chaincfg/chainhash"
@@ -21,10 +20,25 @@ var (
 	// transactions have been seen by the fee generator to give an estimate
 	ErrNotEnoughTxsForEstimate = errors.New("not enough transactions seen for " +
 		"estimation")
+
+	// ErrFeeRateTooLow is the error returned when querying the confirmation
+	// probability of a fee rate lower than the lowest tracked fee rate.
+	ErrFeeRateTooLow = errors.New("fee rate lower than the minimum tracked " +
+		"fee rate")
+
+	// ErrTargetConfTooLow is the error returned when an user of the estimator
+	// requested a target confirmation lower than the upper bound of the first
+	// confirmation range (1 block unless ConfirmRanges groups them), since no
+	// tracked range ensures the txs were confirmed within it.
+	ErrTargetConfTooLow = errors.New("target confirmation lower than the " +
+		"first confirmation range tracked by the estimator")
 )
 
 // ErrTargetConfTooLarge is the type of error returned when an user of the
 // estimator requested a confirmation range higher than tracked by the estimator.
+//
+// Deprecated: targets beyond the tracked confirmation ranges now get an
+// open-ended estimate (see EstimateFeeTarget), so this is no longer returned.
 type ErrTargetConfTooLarge struct {
 	MaxConfirms int32
 	ReqConfirms int32
@@ -36,8 +50,75 @@ func (e ErrTargetConfTooLarge) Error() string {
 		e.MaxConfirms)
 }
 
+// ErrMemPoolInconsistency is the type of error reported when the mempool
+// statistics of the estimator are found to be inconsistent with the tracked
+// mempool transactions, which means a transaction was removed from them
+// without having been added. The estimator recovers by clamping the affected
+// counts and resyncing the statistics, so this is meant for diagnostics.
+type ErrMemPoolInconsistency struct {
+	BucketIndex  int32
+	ConfirmIndex int32
+	TxCount      float64
+}
+
+func (e ErrMemPoolInconsistency) Error() string {
+	return fmt.Sprintf("transaction count in bucket index %d and confirmation "+
+		"index %d became < 0 (%f)", e.BucketIndex, e.ConfirmIndex, e.TxCount)
+}
+
 type feeRate float64
 
+// EstimateMode selects which fee rate of the range of fee rate buckets found
+// when estimating fees is returned as the estimate.
+type EstimateMode int
+
+const (
+	// EstimateMedian returns the median fee rate of the transactions confirmed
+	// in the range (the average fee rate of the bucket holding the median)
+	EstimateMedian EstimateMode = iota
+
+	// EstimateP10, EstimateP25, EstimateP75 and EstimateP90 return the
+	// respective percentiles of the fee rates of the transactions confirmed in
+	// the range, interpolated within the bucket holding the percentile.
+	// Lower percentiles are cheaper but slower in practice.
+	EstimateP10
+	EstimateP25
+	EstimateP75
+	EstimateP90
+
+	// EstimateLowerBound returns the lowest fee rate that falls into the
+	// lowest fee rate bucket of the range (ie, right above the upper boundary
+	// of the bucket below it), which is the floor of the fee rates considered
+	// as passing
+	EstimateLowerBound
+
+	numEstimateModes
+)
+
+var estimateModeNames = [numEstimateModes]string{
+	EstimateMedian:     "median",
+	EstimateP10:        "p10",
+	EstimateP25:        "p25",
+	EstimateP75:        "p75",
+	EstimateP90:        "p90",
+	EstimateLowerBound: "lower",
+}
+
+var estimateModePercentiles = [numEstimateModes]float64{
+	EstimateMedian: 0.5,
+	EstimateP10:    0.1,
+	EstimateP25:    0.25,
+	EstimateP75:    0.75,
+	EstimateP90:    0.9,
+}
+
+func (m EstimateMode) String() string {
+	if m < 0 || m >= numEstimateModes {
+		return "unknown"
+	}
+	return estimateModeNames[m]
+}
+
 type txConfirmStatBucketCount struct {
 	txCount float64
 	feeSum  float64
@@ -52,9 +133,19 @@ type txConfirmStatBucket struct {
 // FeeEstimatorConfig stores the configuration parameters for a given fee
 // estimator. It is used to initialize an empty fee estimator.
 type FeeEstimatorConfig struct {
-	// MaxConfirms is the maximum number of confirmation ranges to check
+	// MaxConfirms is the maximum number of confirmation ranges to check. Each
+	// range tracks a single number of blocks, except for the last one which
+	// tracks every confirmation after the second to last range.
 	MaxConfirms uint32
 
+	// ConfirmRanges, if not empty, defines the confirmation ranges instead of
+	// MaxConfirms (which must then be zero) as their upper bounds (in blocks),
+	// in increasing order. A last range tracking every confirmation above the
+	// highest bound is always added. This allows grouping the confirmations
+	// of long horizons (eg: 1, 2, 3, 4, 6, 8, 12, ..., 144, 288) instead of
+	// tracking each number of blocks.
+	ConfirmRanges []uint32
+
 	// MinBucketFee is the value of the fee rate of the lowest bucket for which
 	// estimation is tracked
 	MinBucketFee dcrutil.Amount
@@ -66,6 +157,221 @@ type FeeEstimatorConfig struct {
 	// FeeRateStep is the multiplier to generate the fee rate buckets (each
 	// bucket is higher than the previous one by this factor)
 	FeeRateStep float64
+
+	// BucketLayout, if not empty, defines the fee rate buckets instead of
+	// MinBucketFee, MaxBucketFee and FeeRateStep (which must then be zero).
+	// The layout defined by those also has a bucket pinned at 0.001 DCR/KB.
+	BucketLayout BucketLayout
+
+	// Decay is the factor applied to the recorded statistics on every new
+	// block, so that older data gradually loses weight. Must be in the (0, 1)
+	// range. Defaults to DefaultDecay.
+	Decay float64
+
+	// DecayHalfLife is an alternative way to specify Decay: the number of
+	// blocks after which the weight of the recorded statistics is halved. Only
+	// one of Decay and DecayHalfLife may be set.
+	DecayHalfLife uint32
+
+	// SuccessPct is the minimum ratio of txs that must have been confirmed
+	// within the target confirmation range at the estimated fee rate. Must be
+	// in the (0, 1] range. Defaults to DefaultSuccessPct.
+	SuccessPct float64
+
+	// MinTxCount is the minimum number of (decayed) txs that a range of fee
+	// rate buckets must have for its success ratio to be considered. Defaults
+	// to DefaultMinTxCount.
+	MinTxCount float64
+
+	// FeeRateMode is how the fee rate of txs is computed from their fee and
+	// size. Defaults to FeeRateDownsampled.
+	FeeRateMode FeeRateMode
+}
+
+// FeeRateMode selects how the fee rate (in atoms/KB) of a transaction is
+// computed from its fee (in atoms) and size (in bytes).
+type FeeRateMode int
+
+const (
+	// FeeRateDownsampled computes fee / size * 1000 using integer division,
+	// which truncates the rate to whole atoms/byte. This naturally
+	// "downsamples" the fee rates towards the minimum at values less than
+	// 0.001 DCR/KB (see AddMemPoolTransactionWithAncestors), but also makes
+	// every rate below 1 atom/byte zero.
+	FeeRateDownsampled FeeRateMode = iota
+
+	// FeeRateExactDown, FeeRateExactNearest and FeeRateExactUp compute
+	// fee * 1000 / size, rounding the result down, to the nearest integer
+	// (with halves rounded up) and up respectively.
+	FeeRateExactDown
+	FeeRateExactNearest
+	FeeRateExactUp
+
+	numFeeRateModes
+)
+
+var feeRateModeNames = [numFeeRateModes]string{
+	FeeRateDownsampled:  "downsampled",
+	FeeRateExactDown:    "exactDown",
+	FeeRateExactNearest: "exactNearest",
+	FeeRateExactUp:      "exactUp",
+}
+
+func (m FeeRateMode) String() string {
+	if m < 0 || m >= numFeeRateModes {
+		return fmt.Sprintf("FeeRateMode(%d)", int(m))
+	}
+	return feeRateModeNames[m]
+}
+
+// txFeeRate returns the fee rate (in atoms/KB) of a transaction with the given
+// fee (in atoms) and size (in bytes).
+func (m FeeRateMode) txFeeRate(fee, size int64) feeRate {
+	switch m {
+	case FeeRateExactDown:
+		return feeRate(fee * 1000 / size)
+	case FeeRateExactNearest:
+		return feeRate((fee*1000 + size/2) / size)
+	case FeeRateExactUp:
+		return feeRate((fee*1000 + size - 1) / size)
+	}
+	return feeRate(fee / size * 1000)
+}
+
+const (
+	// DefaultDecay is the decay used when none is specified in the config
+	// (based on the original bitcoin core code). This is a half-life of
+	// roughly 346 blocks.
+	DefaultDecay = 0.998
+
+	// DefaultSuccessPct is the success pct used when none is specified in the
+	// config
+	DefaultSuccessPct = 0.95
+
+	// DefaultMinTxCount is the minimum tx count used when none is specified in
+	// the config
+	DefaultMinTxCount = 1
+
+	// MaxConfirmBlocks is the highest number of blocks that can be tracked by
+	// the confirmation ranges of an estimator (MaxConfirms or the bounds in
+	// ConfirmRanges). This is two weeks of blocks, far longer than txs are
+	// expected to wait in the mempool.
+	MaxConfirmBlocks = 4032
+)
+
+// Validate returns an error describing the first invalid parameter found in
+// the config. Unset (zero) tuning parameters are valid and replaced by their
+// defaults.
+func (cfg *FeeEstimatorConfig) Validate() error {
+	// The last confirmation range tracks every confirmation after the second
+	// to last one, so at least two ranges are needed.
+	if len(cfg.ConfirmRanges) > 0 {
+		if cfg.MaxConfirms != 0 {
+			return errors.New("MaxConfirms can't be set along with " +
+				"ConfirmRanges")
+		}
+		for i, c := range cfg.ConfirmRanges {
+			if c == 0 {
+				return fmt.Errorf("ConfirmRanges[%d] must be positive", i)
+			}
+			if c > MaxConfirmBlocks {
+				return fmt.Errorf("ConfirmRanges[%d] (%d) must be at most %d",
+					i, c, MaxConfirmBlocks)
+			}
+			if i > 0 && c <= cfg.ConfirmRanges[i-1] {
+				return fmt.Errorf("ConfirmRanges must be in increasing "+
+					"order (%d follows %d)", c, cfg.ConfirmRanges[i-1])
+			}
+		}
+	} else if cfg.MaxConfirms < 2 || cfg.MaxConfirms > MaxConfirmBlocks {
+		return fmt.Errorf("MaxConfirms (%d) must be in the [2, %d] range",
+			cfg.MaxConfirms, MaxConfirmBlocks)
+	}
+	if !cfg.BucketLayout.isEmpty() {
+		if cfg.MinBucketFee != 0 || cfg.MaxBucketFee != 0 ||
+			cfg.FeeRateStep != 0 {
+			return errors.New("MinBucketFee, MaxBucketFee and FeeRateStep " +
+				"can't be set along with a BucketLayout")
+		}
+		if err := cfg.BucketLayout.validate(); err != nil {
+			return err
+		}
+	} else {
+		if cfg.MinBucketFee <= 0 {
+			return fmt.Errorf("MinBucketFee (%v) must be positive",
+				cfg.MinBucketFee)
+		}
+		if cfg.MaxBucketFee <= cfg.MinBucketFee {
+			return fmt.Errorf("MaxBucketFee (%v) must be higher than "+
+				"MinBucketFee (%v)", cfg.MaxBucketFee, cfg.MinBucketFee)
+		}
+		// (written this way so that NaNs are also rejected)
+		if !(cfg.FeeRateStep > 1) || math.IsInf(cfg.FeeRateStep, 1) {
+			return fmt.Errorf("FeeRateStep (%f) must be a finite number "+
+				"higher than 1", cfg.FeeRateStep)
+		}
+	}
+	if cfg.Decay != 0 && cfg.DecayHalfLife != 0 {
+		return errors.New("only one of Decay and DecayHalfLife may be set")
+	}
+	if !(cfg.Decay >= 0 && cfg.Decay < 1) {
+		return fmt.Errorf("Decay (%f) must be in the (0, 1) range", cfg.Decay)
+	}
+	if !(cfg.SuccessPct >= 0 && cfg.SuccessPct <= 1) {
+		return fmt.Errorf("SuccessPct (%f) must be in the (0, 1] range",
+			cfg.SuccessPct)
+	}
+	if !(cfg.MinTxCount >= 0) || math.IsInf(cfg.MinTxCount, 1) {
+		return fmt.Errorf("MinTxCount (%f) must be a finite, non negative "+
+			"number", cfg.MinTxCount)
+	}
+	if cfg.FeeRateMode < 0 || cfg.FeeRateMode >= numFeeRateModes {
+		return fmt.Errorf("FeeRateMode (%d) is unknown", cfg.FeeRateMode)
+	}
+	return nil
+}
+
+// decay returns the decay factor to use for the config.
+func (cfg *FeeEstimatorConfig) decay() float64 {
+	if cfg.DecayHalfLife != 0 {
+		return math.Pow(0.5, 1/float64(cfg.DecayHalfLife))
+	}
+	if cfg.Decay != 0 {
+		return cfg.Decay
+	}
+	return DefaultDecay
+}
+
+// successPct returns the success pct to use for the config.
+func (cfg *FeeEstimatorConfig) successPct() float64 {
+	if cfg.SuccessPct != 0 {
+		return cfg.SuccessPct
+	}
+	return DefaultSuccessPct
+}
+
+// minTxCount returns the minimum tx count to use for the config.
+func (cfg *FeeEstimatorConfig) minTxCount() float64 {
+	if cfg.MinTxCount != 0 {
+		return cfg.MinTxCount
+	}
+	return DefaultMinTxCount
+}
+
+// minDecayScale is the decay scale of the estimator below which its recorded
+// statistics are renormalized (multiplied by the scale), so that the values
+// recorded divided by the scale don't grow unbounded.
+const minDecayScale = 1e-50
+
+// memPoolCohort holds the mempool stats of the txs added at a given block
+// height, which are all in the same confirmation range until they reach its
+// upper bound and are moved to the next one together.
+type memPoolCohort struct {
+	addedHeight int64
+	confirmIdx  int32
+
+	// counts has the stats of the fee rate buckets with txs in the cohort
+	counts map[int32]txConfirmStatBucketCount
 }
 
 // memPoolTxDesc is an aux structure used to track the local estimator mempool
@@ -80,92 +386,102 @@ type memPoolTxDesc struct {
 // within a target block window.
 type FeeEstimator struct {
 	bucketFeeBounds []feeRate
+	pinnedFees      []feeRate
 	buckets         []txConfirmStatBucket
 	memPool         []txConfirmStatBucket
 	maxConfirms     int32
+	confirmBounds   []int32
+	confirmIdx      []int32
 	decay           float64
+	successPct      float64
+	minTxCount      float64
+	feeRateMode     FeeRateMode
 	bestHeight      int64
 	memPoolTxs      map[chainhash.Hash]memPoolTxDesc
+
+	// decayScale is the factor by which the recorded statistics of the mined
+	// txs must be multiplied to get their decayed values. Instead of decaying
+	// every statistic on each block, only this factor is decayed and new
+	// statistics are recorded divided by it, so that the older ones lose
+	// weight relative to them.
+	decayScale float64
+
+	// memPoolCohorts holds the cohorts of mempool txs not yet in the last
+	// confirmation range, keyed by the height at which they reach the upper
+	// bound of their current range. This is used to move the txs to the next
+	// range at that height, so only the cohorts crossing a range bound need
+	// to be visited on each block.
+	memPoolCohorts map[int64][]*memPoolCohort
+
+	// inconsistencyHandler is called when an inconsistency is found in the
+	// mempool statistics
+	inconsistencyHandler func(err error)
 }
 
-// NewFeeEstimator returns an empty estimator given a config. This estimator
-// then needs to be fed data for published and mined transactions before it can
-// be used to estimate fees for new transactions.
-func NewFeeEstimator(cfg *FeeEstimatorConfig) *FeeEstimator {
-	// some constants based on the original bitcoin core code
-	decay := 0.998
-	maxConfirms := cfg.MaxConfirms
-	bucketFees := make([]feeRate, 0)
-	max := float64(cfg.MaxBucketFee)
-	prevF := 0.0
-	for f := float64(cfg.MinBucketFee); f < max; f *= cfg.FeeRateStep {
-		if (f > 1e5) && (prevF < 1e5) {
-			// Add a bucket at the current exact fee rate that the wallet
-			// usually uses (0.001 DCR/KB) in order to improve estimation at
-			// this level. Once the network in general and the default wallet in
-			// particular start using the lower minimum relay rate, this can
-			// probably be dropped.
-			bucketFees = append(bucketFees, feeRate(1e5))
-		}
-		bucketFees = append(bucketFees, feeRate(f))
-		prevF = f
+// NewFeeEstimator returns an empty estimator given a config, or an error if the
+// config is invalid (see Validate). This estimator then needs to be fed data
+// for published and mined transactions before it can be used to estimate fees
+// for new transactions.
+func NewFeeEstimator(cfg *FeeEstimatorConfig) (*FeeEstimator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	// The last bucket catches everything else, so it uses an upper bound of
-	// +inf which any rate must be lower than
-	bucketFees = append(bucketFees, feeRate(math.Inf(1)))
+	bucketFees, pinnedFees := cfg.bucketLayout()
+	confirmBounds := cfg.confirmBounds()
+	nbRanges := len(confirmBounds) + 1
+
+	// The targets up to the highest bound are estimated using the tracked
+	// ranges and the one right after it using the last range.
+	maxConfirms := confirmBounds[len(confirmBounds)-1] + 1
 
 	nbBuckets := len(bucketFees)
 	res := &FeeEstimator{
 		bucketFeeBounds: bucketFees,
+		pinnedFees:      pinnedFees,
 		buckets:         make([]txConfirmStatBucket, nbBuckets),
 		memPool:         make([]txConfirmStatBucket, nbBuckets),
-		maxConfirms:     int32(maxConfirms),
-		decay:           decay,
+		maxConfirms:     maxConfirms,
+		confirmBounds:   confirmBounds,
+		confirmIdx:      make([]int32, maxConfirms-1),
+		decayScale:      1,
+		memPoolCohorts:  make(map[int64][]*memPoolCohort),
+		decay:           cfg.decay(),
+		successPct:      cfg.successPct(),
+		minTxCount:      cfg.minTxCount(),
+		feeRateMode:     cfg.FeeRateMode,
 		memPoolTxs:      make(map[chainhash.Hash]memPoolTxDesc),
 		bestHeight:      -1,
 	}
 
 	for i := range bucketFees {
 		res.buckets[i] = txConfirmStatBucket{
-			confirmed: make([]txConfirmStatBucketCount, maxConfirms),
+			confirmed: make([]txConfirmStatBucketCount, nbRanges),
 		}
 		res.memPool[i] = txConfirmStatBucket{
-			confirmed: make([]txConfirmStatBucketCount, maxConfirms),
+			confirmed: make([]txConfirmStatBucketCount, nbRanges),
 		}
 	}
-
-	return res
-}
-
-// dumpBuckets returns the internal estimator state as a string
-func (stats *FeeEstimator) dumpBuckets() string {
-	res := "          |"
-	for c := 0; c < int(stats.maxConfirms); c++ {
-		if c == int(stats.maxConfirms)-1 {
-			res += fmt.Sprintf("   %14s", "+Inf")
-		} else {
-			res += fmt.Sprintf("   %14d|", c+1)
+	c := int32(0)
+	for blocks := range res.confirmIdx {
+		if int32(blocks+1) > confirmBounds[c] {
+			c++
 		}
+		res.confirmIdx[blocks] = c
 	}
-	res += "\n"
 
-	l := len(stats.bucketFeeBounds)
-	for i := 0; i < l; i++ {
-		res += fmt.Sprintf("%10.8f", stats.bucketFeeBounds[i]/1e8)
-		for c := 0; c < int(stats.maxConfirms); c++ {
-			avg := float64(0)
-			count := stats.buckets[i].confirmed[c].txCount
-			if stats.buckets[i].confirmed[c].txCount > 0 {
-				avg = stats.buckets[i].confirmed[c].feeSum / stats.buckets[i].confirmed[c].txCount / 1e8
-			}
+	return res, nil
+}
 
-			res += fmt.Sprintf("| %.8f %5.0f", avg, count)
-		}
-		res += "\n"
-	}
+// decayHalfLife returns the number of blocks after which the weight of the
+// recorded statistics is halved.
+func (stats *FeeEstimator) decayHalfLife() float64 {
+	return math.Log(0.5) / math.Log(stats.decay)
+}
 
-	return res
+// dumpBuckets returns the internal estimator state as a string
+func (stats *FeeEstimator) dumpBuckets() string {
+	return stats.Snapshot().Text()
 }
 
 // lowerBucket returns the bucket that has the highest upperBound such that it
@@ -180,13 +496,107 @@ func (stats *FeeEstimator) lowerBucket(rate feeRate) int32 {
 // confirmRange returns the confirmation range index to be used for the given
 // number of blocks to confirm. The last confirmation range has an upper bound
 // of +inf to mean that it represents all confirmations higher than the second
-// to last bucket.
+// to last bucket. Non positive numbers of blocks use the first range.
 func (stats *FeeEstimator) confirmRange(blocksToConfirm int32) int32 {
-	idx := blocksToConfirm - 1
-	if idx >= stats.maxConfirms {
-		return stats.maxConfirms - 1
+	if blocksToConfirm >= stats.maxConfirms {
+		return int32(len(stats.confirmBounds))
+	}
+	if blocksToConfirm < 1 {
+		return 0
+	}
+	return stats.confirmIdx[blocksToConfirm-1]
+}
+
+// targetRange returns the confirmation range index to be used when estimating
+// for the given target confirmation: the highest range whose upper bound is
+// not higher than the target (so that its txs were all confirmed within the
+// target), or the first one for targets lower than every bound (which callers
+// are expected to reject). The target right after the highest bound uses the
+// last range.
+func (stats *FeeEstimator) targetRange(targetConfs int32) int32 {
+	if targetConfs >= stats.maxConfirms {
+		return int32(len(stats.confirmBounds))
+	}
+	if targetConfs < 1 {
+		return 0
+	}
+	c := stats.confirmIdx[targetConfs-1]
+	if c > 0 && stats.confirmBounds[c] > targetConfs {
+		c--
+	}
+	return c
+}
+
+// scheduleCohort tracks a cohort of mempool txs to be moved to the next
+// confirmation range once its txs reach the upper bound of the current one.
+// The cohorts crossing a bound at the same height are kept sorted from the
+// highest range to the lowest one, so that the txs are moved out of a range
+// before the ones of the previous range are moved in.
+func (stats *FeeEstimator) scheduleCohort(cohort *memPoolCohort) {
+	height := cohort.addedHeight + int64(stats.confirmBounds[cohort.confirmIdx])
+	cohorts := stats.memPoolCohorts[height]
+	i := sort.Search(len(cohorts), func(i int) bool {
+		return cohorts[i].confirmIdx < cohort.confirmIdx
+	})
+	cohorts = append(cohorts, nil)
+	copy(cohorts[i+1:], cohorts[i:])
+	cohorts[i] = cohort
+	stats.memPoolCohorts[height] = cohorts
+}
+
+// findCohort returns the cohort of the mempool txs added at the given height,
+// which are now in the given confirmation range, or nil if there is none.
+func (stats *FeeEstimator) findCohort(addedHeight int64, confirmIdx int32) *memPoolCohort {
+	height := addedHeight + int64(stats.confirmBounds[confirmIdx])
+	for _, cohort := range stats.memPoolCohorts[height] {
+		if cohort.addedHeight == addedHeight {
+			return cohort
+		}
 	}
-	return idx
+	return nil
+}
+
+// addToCohort adds a mempool tx added at the given height, which is now in the
+// given confirmation range (other than the last one), to its cohort.
+func (stats *FeeEstimator) addToCohort(addedHeight int64, confirmIdx,
+	bucketIdx int32, fees feeRate) {
+
+	cohort := stats.findCohort(addedHeight, confirmIdx)
+	if cohort == nil {
+		cohort = &memPoolCohort{
+			addedHeight: addedHeight,
+			confirmIdx:  confirmIdx,
+			counts:      make(map[int32]txConfirmStatBucketCount),
+		}
+		stats.scheduleCohort(cohort)
+	}
+	count := cohort.counts[bucketIdx]
+	count.feeSum += float64(fees)
+	count.txCount++
+	cohort.counts[bucketIdx] = count
+}
+
+// removeFromCohort removes a mempool tx added at the given height, which is
+// now in the given confirmation range (other than the last one), from its
+// cohort. Empty cohorts are dropped once they reach their range bound.
+func (stats *FeeEstimator) removeFromCohort(addedHeight int64, confirmIdx,
+	bucketIdx int32, fees feeRate) {
+
+	cohort := stats.findCohort(addedHeight, confirmIdx)
+	if cohort == nil {
+		return
+	}
+	count, ok := cohort.counts[bucketIdx]
+	if !ok {
+		return
+	}
+	count.feeSum -= float64(fees)
+	count.txCount--
+	if count.txCount <= 0 {
+		delete(cohort.counts, bucketIdx)
+		return
+	}
+	cohort.counts[bucketIdx] = count
 }
 
 // updateMovingAverages updates the moving averages for the existing confirmed
@@ -198,47 +608,72 @@ func (stats *FeeEstimator) updateMovingAverages(newHeight int64) {
 	feesLog.Debugf("Updated moving averages into block %d", newHeight)
 
 	// decay the existing stats so that, over time, we rely on more up to date
-	// information regarding fees.
-	for b := 0; b < len(stats.buckets); b++ {
-		bucket := &stats.buckets[b]
-		bucket.feeSum *= stats.decay
-		bucket.confirmCount *= stats.decay
-		for c := 0; c < len(bucket.confirmed); c++ {
-			conf := &bucket.confirmed[c]
-			conf.feeSum *= stats.decay
-			conf.txCount *= stats.decay
-		}
+	// information regarding fees. This only requires decaying the scale of
+	// the stats, except when it gets too small.
+	stats.decayScale *= stats.decay
+	if stats.decayScale < minDecayScale {
+		stats.renormalize()
+	}
+
+	if newHeight != stats.bestHeight+1 {
+		// the txs of several blocks would need to be moved, so rebuild the
+		// mempool stats instead
+		stats.bestHeight = newHeight
+		stats.ResyncMemPool()
+		return
 	}
 
 	// For unconfirmed (mempool) transactions, every transaction will now take
-	// at least one additional block to confirm. So for every fee bucket, we
-	// move the stats up one confirmation range.
-	for b := 0; b < len(stats.memPool); b++ {
-		bucket := &stats.memPool[b]
-
-		// the last confirmation range represents all txs confirmed at >= than
-		// the initial maxConfirms, so we *add* the second to last range into
-		// the last range
-		c := len(bucket.confirmed) - 1
-		bucket.confirmed[c].txCount += bucket.confirmed[c-1].txCount
-		bucket.confirmed[c].feeSum += bucket.confirmed[c-1].feeSum
-
-		// for the other ranges, just move up the stats
-		for c--; c > 0; c-- {
-			bucket.confirmed[c] = bucket.confirmed[c-1]
+	// at least one additional block to confirm. So the cohorts of txs that
+	// reached the upper bound of their confirmation range (the ones added
+	// that many blocks ago) are moved up to the next range, starting at the
+	// highest ranges so that the txs moved out of a range are the ones that
+	// were there before this block. The last confirmation range represents
+	// all txs confirmed at >= than the initial maxConfirms, so txs are only
+	// added to it and its cohorts are dropped.
+	lastRange := int32(len(stats.confirmBounds))
+	due := stats.memPoolCohorts[newHeight]
+	delete(stats.memPoolCohorts, newHeight)
+	for _, cohort := range due {
+		c := cohort.confirmIdx
+		for b, count := range cohort.counts {
+			from := &stats.memPool[b].confirmed[c]
+			to := &stats.memPool[b].confirmed[c+1]
+			from.txCount -= count.txCount
+			from.feeSum -= count.feeSum
+			if from.txCount <= 0 {
+				*from = txConfirmStatBucketCount{}
+			}
+			to.txCount += count.txCount
+			to.feeSum += count.feeSum
+		}
+		cohort.confirmIdx++
+		if cohort.confirmIdx < lastRange && len(cohort.counts) > 0 {
+			stats.scheduleCohort(cohort)
 		}
-		// copy(bucket.confirmed[1:c-1], bucket.confirmed[2:c-1])z
-
-		// and finally, the very first confirmation range (ie, what will enter
-		// the mempool now that a new block has been mined) is zeroed so we can
-		// start tracking brand new txs.
-		bucket.confirmed[0].txCount = 0
-		bucket.confirmed[0].feeSum = 0
 	}
 
 	stats.bestHeight = newHeight
 }
 
+// renormalize multiplies the recorded statistics of the mined txs by the decay
+// scale, so that it can be reset.
+func (stats *FeeEstimator) renormalize() {
+	feesLog.Debugf("Renormalizing stats with decay scale %g", stats.decayScale)
+
+	for b := 0; b < len(stats.buckets); b++ {
+		bucket := &stats.buckets[b]
+		bucket.feeSum *= stats.decayScale
+		bucket.confirmCount *= stats.decayScale
+		for c := 0; c < len(bucket.confirmed); c++ {
+			conf := &bucket.confirmed[c]
+			conf.feeSum *= stats.decayScale
+			conf.txCount *= stats.decayScale
+		}
+	}
+	stats.decayScale = 1
+}
+
 // newMemPoolTx records a new memPool transaction into the stats. A brand new
 // mempool transaction has a minimum confirmation range of 1, so it is inserted
 // into the very first confirmation range bucket of the appropriate fee rate
@@ -247,6 +682,8 @@ func (stats *FeeEstimator) newMemPoolTx(bucketIdx int32, fees feeRate) {
 	conf := &stats.memPool[bucketIdx].confirmed[0]
 	conf.feeSum += float64(fees)
 	conf.txCount++
+
+	stats.addToCohort(stats.bestHeight, 0, bucketIdx, fees)
 }
 
 // newMinedTx moves a mined tx from the mempool into the confirmed statistics.
@@ -263,58 +700,213 @@ func (stats *FeeEstimator) newMinedTx(blocksToConfirm int32, rate feeRate) {
 	// mined. This is used to simplify the bucket selection during estimation,
 	// so that we only need to check a single confirmation range (instead of
 	// iterating to sum all confirmations with <= `minConfs`).
+	// The stats are recorded divided by the decay scale.
+	weight := 1 / stats.decayScale
+	fees := float64(rate) * weight
 	for c := int(confirmIdx); c < len(bucket.confirmed); c++ {
 		conf := &bucket.confirmed[c]
-		conf.feeSum += float64(rate)
-		conf.txCount++
+		conf.feeSum += fees
+		conf.txCount += weight
 	}
-	bucket.confirmCount++
-	bucket.feeSum += float64(rate)
+	bucket.confirmCount += weight
+	bucket.feeSum += fees
 }
 
-func (stats *FeeEstimator) removeFromMemPool(blocksInMemPool int32, rate feeRate) {
+// removeFromMemPool removes a tx from the mempool statistics. If the tx count
+// of its confirmation range becomes negative (meaning the tx was not previously
+// added by newMemPoolTx), the range is clamped to zero and an
+// ErrMemPoolInconsistency is returned.
+func (stats *FeeEstimator) removeFromMemPool(blocksInMemPool int32, rate feeRate) error {
 	bucketIdx := stats.lowerBucket(rate)
 	confirmIdx := stats.confirmRange(blocksInMemPool + 1)
+	if confirmIdx < int32(len(stats.confirmBounds)) {
+		// the tx hasn't been moved to the last range yet, so it's still
+		// tracked in its cohort
+		stats.removeFromCohort(stats.bestHeight-int64(blocksInMemPool),
+			confirmIdx, bucketIdx, rate)
+	}
 	bucket := &stats.memPool[bucketIdx]
 	conf := &bucket.confirmed[confirmIdx]
 	conf.feeSum -= float64(rate)
 	conf.txCount--
 	if conf.txCount < 0 {
-		// if this happens, it means a transaction has been called on this
-		// function but not on a previous newMemPoolTx.
-		feesLog.Errorf("Transaction count in bucket index %d and confirmation "+
-			"index %d became < 0", bucketIdx, confirmIdx)
+		err := ErrMemPoolInconsistency{
+			BucketIndex:  bucketIdx,
+			ConfirmIndex: confirmIdx,
+			TxCount:      conf.txCount,
+		}
+		feesLog.Errorf("Inconsistent mempool stats: %v", err)
+		conf.txCount = 0
+		conf.feeSum = 0
+		return err
+	}
+	return nil
+}
+
+// SetInconsistencyHandler sets a function to be called with an
+// ErrMemPoolInconsistency whenever the mempool statistics are found to be
+// inconsistent, right before they are resynced.
+func (stats *FeeEstimator) SetInconsistencyHandler(handler func(err error)) {
+	stats.inconsistencyHandler = handler
+}
+
+// reportInconsistency reports an inconsistency found in the mempool statistics
+// to the handler, if any.
+func (stats *FeeEstimator) reportInconsistency(err error) {
+	if stats.inconsistencyHandler != nil {
+		stats.inconsistencyHandler(err)
+	}
+}
+
+// expectedMemPool returns the mempool statistics expected from the tracked
+// mempool transactions and the current best height.
+func (stats *FeeEstimator) expectedMemPool() []txConfirmStatBucket {
+	res := make([]txConfirmStatBucket, len(stats.memPool))
+	for b := range res {
+		res[b].confirmed = make([]txConfirmStatBucketCount,
+			len(stats.confirmBounds)+1)
+	}
+
+	for _, desc := range stats.memPoolTxs {
+		// this mirrors the confirmation range used when removing txs
+		confirmIdx := stats.confirmRange(int32(stats.bestHeight-desc.addedHeight) + 1)
+		conf := &res[desc.bucketIndex].confirmed[confirmIdx]
+		conf.feeSum += float64(desc.fees)
+		conf.txCount++
+	}
+	return res
+}
+
+// ResyncMemPool rebuilds the mempool statistics from the tracked mempool
+// transactions and the current best height. This is done automatically after
+// an inconsistency is found.
+func (stats *FeeEstimator) ResyncMemPool() {
+
+	// TODO: add lock
+
+	feesLog.Infof("Resyncing mempool stats from %d txs", len(stats.memPoolTxs))
+	stats.memPool = stats.expectedMemPool()
 
-		// TODO: remove panic from here... shouldn't happen when using the
-		// public API
-		panic(fmt.Errorf("wrong usage %d ; %d ; %f", confirmIdx, blocksInMemPool, conf.txCount))
+	stats.memPoolCohorts = make(map[int64][]*memPoolCohort)
+	for _, desc := range stats.memPoolTxs {
+		confirmIdx := stats.confirmRange(int32(stats.bestHeight-desc.addedHeight) + 1)
+		if confirmIdx == int32(len(stats.confirmBounds)) {
+			continue
+		}
+		stats.addToCohort(desc.addedHeight, confirmIdx, desc.bucketIndex,
+			desc.fees)
 	}
 }
 
-// estimateMedianFee estimates the median fee rate for the current recorded
+// MemPoolMismatch is a confirmation range of a fee rate bucket whose mempool
+// statistics don't match the ones expected from the tracked mempool
+// transactions.
+type MemPoolMismatch struct {
+	BucketIndex     int32
+	ConfirmIndex    int32
+	TxCount         float64
+	ExpectedTxCount float64
+	FeeSum          float64
+	ExpectedFeeSum  float64
+}
+
+// ErrMemPoolMismatch is the type of error returned by CheckMemPool when the
+// mempool statistics don't match the tracked mempool transactions.
+type ErrMemPoolMismatch struct {
+	Mismatches []MemPoolMismatch
+}
+
+func (e ErrMemPoolMismatch) Error() string {
+	m := e.Mismatches[0]
+	return fmt.Sprintf("%d mismatched mempool stats (first at bucket index %d "+
+		"and confirmation index %d: %f txs with fee sum %f, expected %f txs "+
+		"with fee sum %f)", len(e.Mismatches), m.BucketIndex, m.ConfirmIndex,
+		m.TxCount, m.FeeSum, m.ExpectedTxCount, m.ExpectedFeeSum)
+}
+
+// CheckMemPool is a debugging aid that recomputes the mempool statistics from
+// the tracked mempool transactions and compares them with the incrementally
+// maintained ones. Values are considered equal when their difference is within
+// the given tolerance, relative to the expected value (or absolute, for
+// expected values smaller than 1). Returns an ErrMemPoolMismatch if they
+// differ, in which case the statistics are also resynced (along with the
+// cohorts used to move the txs between confirmation ranges, which could be the
+// source of the mismatch) if repair is true.
+func (stats *FeeEstimator) CheckMemPool(tolerance float64, repair bool) error {
+
+	// TODO: add lock
+
+	differ := func(value, expected float64) bool {
+		return math.Abs(value-expected) > tolerance*math.Max(1, math.Abs(expected))
+	}
+
+	var mismatches []MemPoolMismatch
+	expected := stats.expectedMemPool()
+	for b := range expected {
+		for c := range expected[b].confirmed {
+			conf := &stats.memPool[b].confirmed[c]
+			exp := &expected[b].confirmed[c]
+			if differ(conf.txCount, exp.txCount) || differ(conf.feeSum, exp.feeSum) {
+				mismatches = append(mismatches, MemPoolMismatch{
+					BucketIndex:     int32(b),
+					ConfirmIndex:    int32(c),
+					TxCount:         conf.txCount,
+					ExpectedTxCount: exp.txCount,
+					FeeSum:          conf.feeSum,
+					ExpectedFeeSum:  exp.feeSum,
+				})
+			}
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	err := ErrMemPoolMismatch{Mismatches: mismatches}
+	feesLog.Warnf("Mempool stats check failed: %v", err)
+	if repair {
+		stats.ResyncMemPool()
+	}
+	return err
+}
+
+// estimateMedianFee is estimateFee using the median fee rate of the passing
+// range of buckets.
+func (stats *FeeEstimator) estimateMedianFee(targetConfs int32, successPct float64) (feeRate, error) {
+	return stats.estimateFee(targetConfs, successPct, EstimateMedian)
+}
+
+// estimateFee estimates the median fee rate for the current recorded
 // statistics such that at least successPct transactions have been mined on all
 // tracked fee rate buckets with fee >= to the median.
 // In other words, this is the median fee of the lowest bucket such that it and
 // all higher fee buckets have >= successPct transactions confirmed in at most
 // `targetConfs` confirmations.
+// The mode selects a different percentile of the fee rates of the transactions
+// confirmed in the passing range of buckets instead of the median, or the lower
+// boundary of the range.
+// Targets at or beyond maxConfirms use the last confirmation range, which has
+// no upper bound: the passing range is then the one where successPct of the
+// transactions were confirmed at all (instead of still waiting in the mempool
+// after the highest tracked range), with no guarantee of how long they took.
+// The mode still selects the estimate from that range, so only
+// EstimateLowerBound returns the lowest fee rate that was confirmed at all.
 // Note that sometimes the requested combination of targetConfs and successPct is
 // not achieveable (hypothetical example: 99% of txs confirmed within 1 block)
 // or there are not enough recorded statistics to derive a successful estimate
 // (eg: confirmation tracking has only started or there was a period of very few
 // transactions). In those situations, the appropriate error is returned.
-func (stats *FeeEstimator) estimateMedianFee(targetConfs int32, successPct float64) (feeRate, error) {
-	minTxCount := float64(1)
+func (stats *FeeEstimator) estimateFee(targetConfs int32, successPct float64,
+	mode EstimateMode) (feeRate, error) {
 
-	if (targetConfs - 1) >= stats.maxConfirms {
-		// We might want to add support to use a targetConf at +infinity to
-		// allow us to make estimates at confirmation interval higher than what
-		// we currently track.
-		return 0, ErrTargetConfTooLarge{MaxConfirms: stats.maxConfirms,
-			ReqConfirms: targetConfs}
+	if targetConfs < stats.confirmBounds[0] {
+		return 0, ErrTargetConfTooLow
 	}
 
+	minTxCount := stats.minTxCount
+
 	startIdx := len(stats.buckets) - 1
-	confirmRangeIdx := stats.confirmRange(targetConfs)
+	confirmRangeIdx := stats.targetRange(targetConfs)
 
 	var totalTxs, confirmedTxs float64
 	bestBucketsStt := startIdx
@@ -322,9 +914,10 @@ func (stats *FeeEstimator) estimateMedianFee(targetConfs int32, successPct float
 	curBucketsStt := startIdx
 	curBucketsEnd := startIdx
 
+	scale := stats.decayScale
 	for b := startIdx; b >= 0; b-- {
-		totalTxs += stats.buckets[b].confirmCount
-		confirmedTxs += stats.buckets[b].confirmed[confirmRangeIdx].txCount
+		totalTxs += stats.buckets[b].confirmCount * scale
+		confirmedTxs += stats.buckets[b].confirmed[confirmRangeIdx].txCount * scale
 
 		// add the mempool (unconfirmed) transactions to the total tx count
 		// since a very large mempool for the given bucket might mean that
@@ -355,31 +948,88 @@ func (stats *FeeEstimator) estimateMedianFee(targetConfs int32, successPct float
 	if txCount <= 0 {
 		return 0, ErrNotEnoughTxsForEstimate
 	}
-	txCount = txCount / 2
+
+	if mode == EstimateLowerBound {
+		// The rates in a bucket are higher than the upper bound of the
+		// previous one (so a tx paying exactly that bound falls into the
+		// previous bucket), except on the first bucket which only tracks rates
+		// equal to its bound. Rates are whole atoms/KB, so the lowest one in
+		// the bucket is the next whole rate after the previous bound.
+		if bestBucketsStt == 0 {
+			return stats.bucketFeeBounds[0], nil
+		}
+		lower := feeRate(math.Floor(float64(stats.bucketFeeBounds[bestBucketsStt-1])) + 1)
+		if lower > stats.bucketFeeBounds[bestBucketsStt] {
+			lower = stats.bucketFeeBounds[bestBucketsStt]
+		}
+		return lower, nil
+	}
+
+	txCount = txCount * estimateModePercentiles[mode]
 	for b := bestBucketsStt; b <= bestBucketsEnd; b++ {
-		if stats.buckets[b].confirmCount < txCount {
-			txCount -= stats.buckets[b].confirmCount
-		} else {
-			median := stats.buckets[b].feeSum / stats.buckets[b].confirmCount
-			return feeRate(median), nil
+		bucket := &stats.buckets[b]
+		if bucket.confirmCount < txCount {
+			txCount -= bucket.confirmCount
+			continue
+		}
+		avg := bucket.feeSum / bucket.confirmCount
+		if mode == EstimateMedian {
+			return feeRate(avg), nil
 		}
+		return stats.bucketFeePercentile(b, avg, txCount/bucket.confirmCount), nil
 	}
 
 	return 0, errors.New("this isn't supposed to be reached")
 }
 
-// EstimateFee is the public version of estimateMedianFee. It calculates the suggested fee for a transaction to be confirmed in at most `targetConf` blocks after publishing with a high degree of certainty.
+// bucketFeePercentile returns the fee rate at the given fraction (0-1) of the
+// transactions of a bucket with the given average fee rate. Only the average of
+// each bucket is tracked, so this assumes the fee rates of the lower half of the
+// transactions are evenly spread between the lower boundary of the bucket and
+// the average, and the upper half between the average and the upper boundary.
+func (stats *FeeEstimator) bucketFeePercentile(b int, avg, frac float64) feeRate {
+	lower := float64(stats.bucketFeeBounds[0])
+	if b > 0 {
+		lower = float64(stats.bucketFeeBounds[b-1])
+	}
+	upper := float64(stats.bucketFeeBounds[b])
+
+	if frac <= 0.5 {
+		return feeRate(lower + (avg-lower)*frac*2)
+	}
+	if math.IsInf(upper, 1) {
+		// nothing is known about the fee rates above the average in the last
+		// bucket
+		return feeRate(avg)
+	}
+	return feeRate(avg + (upper-avg)*(frac-0.5)*2)
+}
+
+// EstimateFee is the public version of estimateMedianFee. It calculates the
+// suggested fee for a transaction to be confirmed in at most `targetConf` blocks
+// after publishing with a high degree of certainty. Targets beyond the tracked
+// confirmation ranges get an open-ended estimate (see EstimateFeeTarget), while
+// targets lower than the first range return ErrTargetConfTooLow. Targets within
+// grouped confirmation ranges (see ConfirmRanges) are estimated using the
+// highest range that ends at or before them, so eg, with ranges of up to 2, 4
+// and 8 blocks, a target of 7 blocks gets the estimate for 4 blocks and a
+// target of 1 block is rejected.
 func (stats *FeeEstimator) EstimateFee(targetConfs int32) (dcrutil.Amount, error) {
+	return stats.EstimateFeeMode(targetConfs, EstimateMedian)
+}
 
-	// TODO: add lock
+// EstimateFeeMode is the same as EstimateFee, but returns the fee rate selected
+// by the given mode from the passing range of fee rate buckets. This allows
+// wallets to offer cheaper (lower percentiles) or faster (higher percentiles)
+// options for the same target confirmation.
+func (stats *FeeEstimator) EstimateFeeMode(targetConfs int32, mode EstimateMode) (dcrutil.Amount, error) {
+	if mode < 0 || mode >= numEstimateModes {
+		return 0, fmt.Errorf("unknown estimate mode %d", mode)
+	}
 
-	// FIXME: using for debug. Remove.
-	f, _ := os.Create("debug-fees.txt")
-	f.WriteString(stats.dumpBuckets())
-	f.Sync()
-	f.Close()
+	// TODO: add lock
 
-	rate, err := stats.estimateMedianFee(targetConfs, 0.95)
+	rate, err := stats.estimateFee(targetConfs, stats.successPct, mode)
 	if err != nil {
 		return 0, err
 	}
@@ -387,12 +1037,156 @@ func (stats *FeeEstimator) EstimateFee(targetConfs int32) (dcrutil.Amount, error
 	return dcrutil.Amount(rate), nil
 }
 
+// FeeEstimate is a fee rate estimate for a target confirmation.
+type FeeEstimate struct {
+	// FeeRate is the estimated fee rate (in atoms/KB)
+	FeeRate dcrutil.Amount
+
+	// TargetConfs is the requested target confirmation
+	TargetConfs int32
+
+	// OpenEnded is whether the target is not lower than MaxConfirms, so the
+	// estimate was made using the last confirmation range, which has no upper
+	// bound. In that case the fee rate is selected by the estimate mode from
+	// the lowest range of fee rate buckets whose transactions were confirmed
+	// at all with the required success ratio (eg, their median fee rate with
+	// EstimateMedian, or the lowest fee rate of the range with
+	// EstimateLowerBound), but there is no guarantee that they will be
+	// confirmed within the target.
+	OpenEnded bool
+}
+
+// EstimateFeeTarget is the same as EstimateFeeMode, but also reports whether
+// the estimate is open-ended. This allows users who are happy to wait for a
+// transaction to be confirmed "sometime today" to request targets beyond the
+// tracked confirmation ranges, while knowing the estimate doesn't ensure the
+// target.
+func (stats *FeeEstimator) EstimateFeeTarget(targetConfs int32, mode EstimateMode) (*FeeEstimate, error) {
+	rate, err := stats.EstimateFeeMode(targetConfs, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeeEstimate{
+		FeeRate:     rate,
+		TargetConfs: targetConfs,
+		OpenEnded:   targetConfs >= stats.maxConfirms,
+	}, nil
+}
+
+// ConfirmationEstimate is the estimated likelihood of a transaction paying a
+// given fee rate being confirmed after being published to the network.
+type ConfirmationEstimate struct {
+	// FeeRate is the fee rate (in atoms/KB) of the transaction
+	FeeRate dcrutil.Amount
+
+	// SuccessPct holds, at index i, the probability of the transaction being
+	// confirmed within ConfirmRanges[i] blocks. The last confirmation range has
+	// no upper bound, so its entry is the probability of the transaction being
+	// confirmed at all.
+	SuccessPct []float64
+
+	// ConfirmRanges are the upper bounds (in blocks) of the confirmation
+	// ranges of SuccessPct, except for the last one.
+	ConfirmRanges []int32
+
+	// ExpectedBlocks is the expected number of blocks until the transaction is
+	// confirmed. Transactions that take longer than the second to last
+	// confirmation range are accounted as if confirmed in the last one, so
+	// this is a lower bound for fee rates with a low probability of
+	// confirming within the tracked ranges. When ranges span several blocks,
+	// transactions are accounted as if confirmed at their upper bound.
+	ExpectedBlocks float64
+}
+
+// confirmProbabilities returns the ratio of transactions paying the given fee
+// rate confirmed within each confirmation range, computed the same way as when
+// estimating fees (transactions still in the mempool count as not confirmed).
+// If the bucket of the fee rate doesn't have enough data, it is grouped with
+// the lower fee buckets (and then the higher ones) until it does, so that
+// sparse buckets don't produce optimistic results.
+func (stats *FeeEstimator) confirmProbabilities(rate feeRate) ([]float64, error) {
+	minTxCount := stats.minTxCount
+
+	if rate < stats.bucketFeeBounds[0] {
+		return nil, ErrFeeRateTooLow
+	}
+
+	scale := stats.decayScale
+	sttIdx := int(stats.lowerBucket(rate))
+	endIdx := sttIdx
+	txCount := stats.buckets[sttIdx].confirmCount * scale
+	for txCount <= minTxCount {
+		if sttIdx > 0 {
+			sttIdx--
+			txCount += stats.buckets[sttIdx].confirmCount * scale
+		} else if endIdx < len(stats.buckets)-1 {
+			endIdx++
+			txCount += stats.buckets[endIdx].confirmCount * scale
+		} else {
+			return nil, ErrNotEnoughTxsForEstimate
+		}
+	}
+
+	res := make([]float64, len(stats.confirmBounds)+1)
+	for c := range res {
+		var totalTxs, confirmedTxs float64
+		for b := sttIdx; b <= endIdx; b++ {
+			totalTxs += stats.buckets[b].confirmCount*scale +
+				stats.memPool[b].confirmed[c].txCount
+			confirmedTxs += stats.buckets[b].confirmed[c].txCount * scale
+		}
+		res[c] = confirmedTxs / totalTxs
+	}
+
+	return res, nil
+}
+
+// ConfirmationProbability returns the estimated probability of a transaction
+// paying the given fee rate (in atoms/KB) being confirmed within each tracked
+// confirmation range, along with the expected number of blocks until it is
+// confirmed. This is the inverse of EstimateFee: instead of asking for the fee
+// rate to use for a target confirmation, it answers how likely a given fee rate
+// is to work.
+func (stats *FeeEstimator) ConfirmationProbability(rate dcrutil.Amount) (*ConfirmationEstimate, error) {
+	probs, err := stats.confirmProbabilities(feeRate(rate))
+	if err != nil {
+		return nil, err
+	}
+
+	// The expected number of blocks is the sum of the probabilities of the
+	// transaction not being confirmed after 0, 1, 2, ... blocks. It is never
+	// confirmed after 0 blocks (nor before the upper bound of the first range,
+	// as far as we know), hence the initial value. Within a range, the
+	// probability is the one at its lower bound.
+	bounds := stats.confirmBounds
+	expected := float64(bounds[0])
+	for c := 0; c < len(bounds); c++ {
+		width := int32(1)
+		if c < len(bounds)-1 {
+			width = bounds[c+1] - bounds[c]
+		}
+		expected += (1 - probs[c]) * float64(width)
+	}
+
+	return &ConfirmationEstimate{
+		FeeRate:        rate,
+		SuccessPct:     probs,
+		ConfirmRanges:  append([]int32(nil), bounds...),
+		ExpectedBlocks: expected,
+	}, nil
+}
+
 // SetBestHeight establishes the current best height of the blockchain after
 // initializing the chain. All new mempool transactions will be added at this
-// block height.
+// block height. The mempool statistics of the txs already tracked (eg, when
+// called after a reorg) are rebuilt for the new height.
 func (stats *FeeEstimator) SetBestHeight(bestHeight int64) {
 	feesLog.Tracef("Setting best height as %d", bestHeight)
 	stats.bestHeight = bestHeight
+	if len(stats.memPoolTxs) > 0 {
+		stats.ResyncMemPool()
+	}
 }
 
 // AddMemPoolTransaction to the estimator in order to account for it in the
@@ -400,6 +1194,20 @@ func (stats *FeeEstimator) SetBestHeight(bestHeight int64) {
 // currently recorded best chain hash, using the total fee amount (in atoms) and
 // with the provided size (in bytes).
 func (stats *FeeEstimator) AddMemPoolTransaction(txHash *chainhash.Hash, fee, size int64) {
+	stats.AddMemPoolTransactionWithAncestors(txHash, fee, size, 0, 0)
+}
+
+// AddMemPoolTransactionWithAncestors adds a transaction that spends outputs of
+// other unconfirmed transactions to the estimator. ancestorFee (in atoms) and
+// ancestorSize (in bytes) are the totals for all of its unconfirmed ancestors.
+//
+// Such a transaction can only be mined along with its ancestors, so miners
+// consider it at the lowest of its own fee rate and the fee rate of the package
+// formed by it and its ancestors. The transaction is tracked at this effective
+// fee rate, so that a child paying a high fee rate for a low fee parent doesn't
+// get recorded as a high fee transaction that took long to confirm.
+func (stats *FeeEstimator) AddMemPoolTransactionWithAncestors(txHash *chainhash.Hash,
+	fee, size, ancestorFee, ancestorSize int64) {
 
 	// TODO: add lock
 
@@ -408,13 +1216,21 @@ func (stats *FeeEstimator) AddMemPoolTransaction(txHash *chainhash.Hash, fee, si
 		return
 	}
 
-	// Note that we use this less exact version instead of fee * 1000 / size
-	// (using ints) because it naturally "downsamples" the fee rates towards the
-	// minimum at values less than 0.001 DCR/KB. This is needed because due to
-	// how the wallet estimates the final fee given an input rate and the final
-	// tx size, there's usually a small discrepancy towards a higher effective
-	// rate in the published tx.
-	rate := feeRate(fee / size * 1000)
+	// Note that by default we use the less exact fee / size * 1000 (using
+	// ints) instead of fee * 1000 / size because it naturally "downsamples"
+	// the fee rates towards the minimum at values less than 0.001 DCR/KB. This
+	// is needed because due to how the wallet estimates the final fee given an
+	// input rate and the final tx size, there's usually a small discrepancy
+	// towards a higher effective rate in the published tx. The exact modes
+	// are meant for networks where rates below 1 atom/byte are common.
+	rate := stats.feeRateMode.txFeeRate(fee, size)
+	if ancestorSize > 0 {
+		pkgRate := stats.feeRateMode.txFeeRate(fee+ancestorFee,
+			size+ancestorSize)
+		if pkgRate < rate {
+			rate = pkgRate
+		}
+	}
 
 	if rate < stats.bucketFeeBounds[0] {
 		// Transactions paying less than the current relaying fee can only
@@ -451,9 +1267,13 @@ func (stats *FeeEstimator) RemoveMemPoolTransaction(txHash *chainhash.Hash) {
 
 	feesLog.Debugf("Removing tx %s from mempool", txHash)
 
-	stats.removeFromMemPool(int32(stats.bestHeight-desc.addedHeight), desc.fees)
+	err := stats.removeFromMemPool(int32(stats.bestHeight-desc.addedHeight),
+		desc.fees)
 	delete(stats.memPoolTxs, *txHash)
-	return
+	if err != nil {
+		stats.reportInconsistency(err)
+		stats.ResyncMemPool()
+	}
 }
 
 // ProcessMinedTransactions moves the transactions that exist in the currently
@@ -472,6 +1292,7 @@ func (stats *FeeEstimator) ProcessMinedTransactions(blockHeight int64, txHashes
 
 	stats.updateMovingAverages(blockHeight)
 
+	inconsistent := false
 	for _, txh := range txHashes {
 		desc, exists := stats.memPoolTxs[*txh]
 		if !exists {
@@ -487,8 +1308,13 @@ func (stats *FeeEstimator) ProcessMinedTransactions(blockHeight int64, txHashes
 			continue
 		}
 
-		stats.removeFromMemPool(int32(blockHeight-desc.addedHeight), desc.fees)
+		err := stats.removeFromMemPool(int32(blockHeight-desc.addedHeight),
+			desc.fees)
 		delete(stats.memPoolTxs, *txh)
+		if err != nil {
+			stats.reportInconsistency(err)
+			inconsistent = true
+		}
 
 		if blockHeight <= desc.addedHeight {
 			// this shouldn't usually happen but we need to explicitly test for
@@ -505,6 +1331,10 @@ func (stats *FeeEstimator) ProcessMinedTransactions(blockHeight int64, txHashes
 			desc.fees/1e8, mineDelay)
 		stats.newMinedTx(mineDelay, desc.fees)
 	}
+
+	if inconsistent {
+		stats.ResyncMemPool()
+	}
 }
 
 // ProcessBlock processes all mined transactions in the provided block
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+)
+
+// benchFeeRateSteps are the fee rate steps of the benchmarked estimators, which
+// result in 41 and 373 fee rate buckets respectively.
+var benchFeeRateSteps = []float64{1.1, 1.01}
+
+// benchMaxConfirms are the numbers of confirmation ranges of the benchmarked
+// estimators.
+var benchMaxConfirms = []uint32{32, 288}
+
+// benchMemPoolSizes are the numbers of txs waiting in the mempool of the
+// benchmarked estimators.
+var benchMemPoolSizes = []int{100, 10000}
+
+// benchBlockSizes are the numbers of txs published and mined on each block.
+var benchBlockSizes = []int{10, 1000}
+
+// benchHistoryBlocks is the number of blocks fed to the benchmarked estimators
+// before measuring them, so that they have statistics to estimate from.
+const benchHistoryBlocks = 300
+
+// benchRoundBlocks is the number of blocks whose txs are published at once,
+// outside of the measured time, by the mined txs benchmarks, and after which
+// the mempool stats are reset by the moving averages benchmark.
+const benchRoundBlocks = 16
+
+// benchConfig returns the config of a benchmarked estimator.
+func benchConfig(step float64, maxConfirms uint32) *FeeEstimatorConfig {
+	cfg := validConfig()
+	cfg.FeeRateStep = step
+	cfg.MaxConfirms = maxConfirms
+	return &cfg
+}
+
+// benchName returns the name of a sub-benchmark for the given config and the
+// given additional parameters.
+func benchName(cfg *FeeEstimatorConfig, params ...interface{}) string {
+	bounds, _ := cfg.bucketLayout()
+	name := fmt.Sprintf("buckets=%d/maxConfirms=%d", len(bounds),
+		cfg.MaxConfirms)
+	for i := 0; i+1 < len(params); i += 2 {
+		name += fmt.Sprintf("/%s=%v", params[i], params[i+1])
+	}
+	return name
+}
+
+// benchHash returns the hash of the i-th tx generated by the benchmarks.
+func benchHash(i int) chainhash.Hash {
+	var hash chainhash.Hash
+	hash[0] = byte(i)
+	hash[1] = byte(i >> 8)
+	hash[2] = byte(i >> 16)
+	hash[3] = byte(i >> 24)
+	hash[4] = 1
+	return hash
+}
+
+// benchFee returns the fee (for a 1000 bytes tx) of the i-th tx generated by
+// the benchmarks, so that the fee rates are spread across the buckets.
+func benchFee(i int) int64 {
+	return 10000 + int64(i%97)*3000
+}
+
+// benchEstimator returns a new estimator for the given config, fed with
+// benchHistoryBlocks blocks of blockTxs txs each (mined 1 to 4 blocks after
+// being published) and with memPoolSize txs that are never mined, published
+// over the last blocks. The best height of the estimator is
+// benchHistoryBlocks and the index of the next tx to generate is returned
+// along with the estimator.
+func benchEstimator(b *testing.B, cfg *FeeEstimatorConfig, memPoolSize,
+	blockTxs int) (*FeeEstimator, int) {
+
+	estimator, err := NewFeeEstimator(cfg)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	estimator.SetBestHeight(0)
+
+	const maxDelay = 4
+	next := 0
+	toMine := make([][]*chainhash.Hash, benchHistoryBlocks+maxDelay+1)
+	for height := 1; height <= benchHistoryBlocks; height++ {
+		estimator.ProcessMinedTransactions(int64(height), toMine[height])
+		for i := 0; i < blockTxs; i++ {
+			hash := benchHash(next)
+			estimator.AddMemPoolTransaction(&hash, benchFee(next), 1000)
+			mineHeight := height + 1 + next%maxDelay
+			toMine[mineHeight] = append(toMine[mineHeight], &hash)
+			next++
+		}
+		if height <= benchHistoryBlocks-maxDelay {
+			continue
+		}
+		for i := 0; i < memPoolSize/maxDelay; i++ {
+			hash := benchHash(next)
+			estimator.AddMemPoolTransaction(&hash, benchFee(next), 1000)
+			next++
+		}
+	}
+	return estimator, next
+}
+
+// BenchmarkLowerBucket measures finding the bucket of a fee rate.
+func BenchmarkLowerBucket(b *testing.B) {
+	for _, step := range benchFeeRateSteps {
+		cfg := benchConfig(step, 32)
+		b.Run(benchName(cfg), func(b *testing.B) {
+			estimator, err := NewFeeEstimator(cfg)
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			rates := make([]feeRate, 1024)
+			for i := range rates {
+				rates[i] = feeRate(benchFee(i*7) * 13 / 10)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				estimator.lowerBucket(rates[n%len(rates)])
+			}
+		})
+	}
+}
+
+// BenchmarkAddMemPoolTransaction measures publishing a tx to the mempool.
+func BenchmarkAddMemPoolTransaction(b *testing.B) {
+	for _, step := range benchFeeRateSteps {
+		for _, memPoolSize := range benchMemPoolSizes {
+			cfg := benchConfig(step, 32)
+			b.Run(benchName(cfg, "memPool", memPoolSize), func(b *testing.B) {
+				estimator, next := benchEstimator(b, cfg, memPoolSize, 10)
+				hashes := make([]chainhash.Hash, b.N)
+				for i := range hashes {
+					hashes[i] = benchHash(next + i)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					estimator.AddMemPoolTransaction(&hashes[n],
+						benchFee(next+n), 1000)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkProcessBlock measures the cost of processing a block end to end
+// (mining the txs published a few blocks before and publishing new ones) for
+// estimators with increasing numbers of fee rate buckets and confirmation
+// ranges, starting from an empty estimator.
+func BenchmarkProcessBlock(b *testing.B) {
+	for _, step := range benchFeeRateSteps {
+		for _, maxConfirms := range benchMaxConfirms {
+			cfg := benchConfig(step, maxConfirms)
+			b.Run(benchName(cfg), func(b *testing.B) {
+				benchmarkProcessBlock(b, cfg)
+			})
+		}
+	}
+}
+
+// benchmarkProcessBlock processes b.N blocks of 10 txs each with a new
+// estimator for the given config. The txs are mined 3 blocks after being
+// published, at fee rates spread across the buckets.
+func benchmarkProcessBlock(b *testing.B, cfg *FeeEstimatorConfig) {
+	const delay = 3
+	const blockTxs = 10
+	estimator, err := NewFeeEstimator(cfg)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	estimator.SetBestHeight(0)
+
+	// the txs of each block are kept in a ring until they are mined
+	hashes := make([]chainhash.Hash, (delay+1)*blockTxs)
+	publish := func(block int) {
+		ring := hashes[(block%(delay+1))*blockTxs:]
+		for i := 0; i < blockTxs; i++ {
+			ring[i] = benchHash(block*blockTxs + i)
+			fee := 10000 + int64(i)*30000
+			estimator.AddMemPoolTransaction(&ring[i], fee, 1000)
+		}
+	}
+	for block := 0; block < delay; block++ {
+		publish(block)
+	}
+	mined := make([]*chainhash.Hash, blockTxs)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ring := hashes[(n%(delay+1))*blockTxs:]
+		for i := range mined {
+			mined[i] = &ring[i]
+		}
+		estimator.ProcessMinedTransactions(int64(n+1), mined)
+		publish(n + delay)
+	}
+}
+
+// BenchmarkProcessMinedTransactions measures processing a block that mines the
+// txs published a few blocks before. Publishing the txs is not measured.
+func BenchmarkProcessMinedTransactions(b *testing.B) {
+	for _, step := range benchFeeRateSteps {
+		for _, maxConfirms := range benchMaxConfirms {
+			for _, memPoolSize := range benchMemPoolSizes {
+				for _, blockTxs := range benchBlockSizes {
+					cfg := benchConfig(step, maxConfirms)
+					name := benchName(cfg, "memPool", memPoolSize,
+						"blockTxs", blockTxs)
+					b.Run(name, func(b *testing.B) {
+						benchmarkProcessMinedTransactions(b, cfg,
+							memPoolSize, blockTxs)
+					})
+				}
+			}
+		}
+	}
+}
+
+// benchmarkProcessMinedTransactions processes b.N blocks of blockTxs txs each,
+// after feeding the estimator with a history of blocks of the same size. The
+// txs of every round of benchRoundBlocks blocks are published ahead of the
+// round, while the timer is stopped, so they are mined 1 to benchRoundBlocks
+// blocks after being published.
+func benchmarkProcessMinedTransactions(b *testing.B, cfg *FeeEstimatorConfig,
+	memPoolSize, blockTxs int) {
+
+	estimator, next := benchEstimator(b, cfg, memPoolSize, blockTxs)
+	height := int64(benchHistoryBlocks)
+
+	hashes := make([]chainhash.Hash, benchRoundBlocks*blockTxs)
+	mined := make([][]*chainhash.Hash, benchRoundBlocks)
+	for i := range mined {
+		mined[i] = make([]*chainhash.Hash, blockTxs)
+		for j := range mined[i] {
+			mined[i][j] = &hashes[i*blockTxs+j]
+		}
+	}
+	publish := func() {
+		for i := range hashes {
+			hashes[i] = benchHash(next)
+			estimator.AddMemPoolTransaction(&hashes[i], benchFee(next), 1000)
+			next++
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		round := n % benchRoundBlocks
+		if round == 0 {
+			b.StopTimer()
+			publish()
+			b.StartTimer()
+		}
+		height++
+		estimator.ProcessMinedTransactions(height, mined[round])
+	}
+}
+
+// BenchmarkUpdateMovingAverages measures decaying the statistics and moving
+// the mempool txs across the confirmation ranges on a new block. The mempool
+// stats are reset to the ones of the end of the history after every round of
+// benchRoundBlocks blocks (while the timer is stopped), so that the txs are
+// still moving across the ranges instead of all ending up in the last one.
+func BenchmarkUpdateMovingAverages(b *testing.B) {
+	for _, step := range benchFeeRateSteps {
+		for _, maxConfirms := range benchMaxConfirms {
+			for _, memPoolSize := range benchMemPoolSizes {
+				cfg := benchConfig(step, maxConfirms)
+				b.Run(benchName(cfg, "memPool", memPoolSize), func(b *testing.B) {
+					estimator, _ := benchEstimator(b, cfg, memPoolSize, 10)
+					height := estimator.bestHeight
+
+					b.ReportAllocs()
+					b.ResetTimer()
+					for n := 0; n < b.N; n++ {
+						if n > 0 && n%benchRoundBlocks == 0 {
+							b.StopTimer()
+							estimator.bestHeight = height
+							estimator.ResyncMemPool()
+							b.StartTimer()
+						}
+						estimator.updateMovingAverages(estimator.bestHeight + 1)
+					}
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkEstimateMedianFee measures estimating the fee rate for each of the
+// tracked target confirmations.
+func BenchmarkEstimateMedianFee(b *testing.B) {
+	for _, step := range benchFeeRateSteps {
+		for _, maxConfirms := range benchMaxConfirms {
+			for _, memPoolSize := range benchMemPoolSizes {
+				cfg := benchConfig(step, maxConfirms)
+				b.Run(benchName(cfg, "memPool", memPoolSize), func(b *testing.B) {
+					estimator, _ := benchEstimator(b, cfg, memPoolSize, 100)
+
+					b.ReportAllocs()
+					b.ResetTimer()
+					for n := 0; n < b.N; n++ {
+						target := int32(n%int(estimator.maxConfirms)) + 1
+						estimator.estimateMedianFee(target,
+							estimator.successPct)
+					}
+				})
+			}
+		}
+	}
+}
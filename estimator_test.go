@@ -0,0 +1,1342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil"
+)
+
+// validConfig returns the estimator config used by most test cases of the
+// simulator.
+func validConfig() FeeEstimatorConfig {
+	return FeeEstimatorConfig{
+		MaxConfirms:  32,
+		MinBucketFee: 1e4,
+		MaxBucketFee: 4e5,
+		FeeRateStep:  1.1,
+	}
+}
+
+// TestNewFeeEstimatorInvalidConfig ensures every invalid config is rejected
+// with an error naming the offending parameter.
+func TestNewFeeEstimatorInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *FeeEstimatorConfig)
+		wantErr string
+	}{{
+		name:    "zero max confirms",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MaxConfirms = 0 },
+		wantErr: "MaxConfirms",
+	}, {
+		name:    "single confirmation range",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MaxConfirms = 1 },
+		wantErr: "MaxConfirms",
+	}, {
+		name:    "max confirms beyond the tracked horizon",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MaxConfirms = MaxConfirmBlocks + 1 },
+		wantErr: "MaxConfirms",
+	}, {
+		name:    "max confirms not fitting an int32",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MaxConfirms = math.MaxInt32 + 1 },
+		wantErr: "MaxConfirms",
+	}, {
+		name:    "zero min bucket fee",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MinBucketFee = 0 },
+		wantErr: "MinBucketFee",
+	}, {
+		name:    "negative min bucket fee",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MinBucketFee = -1e4 },
+		wantErr: "MinBucketFee",
+	}, {
+		name:    "min bucket fee higher than max",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MinBucketFee = 5e5 },
+		wantErr: "MaxBucketFee",
+	}, {
+		name:    "min bucket fee equal to max",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MinBucketFee = 4e5 },
+		wantErr: "MaxBucketFee",
+	}, {
+		name:    "zero fee rate step",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.FeeRateStep = 0 },
+		wantErr: "FeeRateStep",
+	}, {
+		name:    "unit fee rate step",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.FeeRateStep = 1 },
+		wantErr: "FeeRateStep",
+	}, {
+		name:    "decreasing fee rate step",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.FeeRateStep = 0.9 },
+		wantErr: "FeeRateStep",
+	}, {
+		name:    "NaN fee rate step",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.FeeRateStep = math.NaN() },
+		wantErr: "FeeRateStep",
+	}, {
+		name:    "infinite fee rate step",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.FeeRateStep = math.Inf(1) },
+		wantErr: "FeeRateStep",
+	}, {
+		name:    "negative decay",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.Decay = -0.5 },
+		wantErr: "Decay",
+	}, {
+		name:    "unit decay",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.Decay = 1 },
+		wantErr: "Decay",
+	}, {
+		name:    "NaN decay",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.Decay = math.NaN() },
+		wantErr: "Decay",
+	}, {
+		name: "both decay and half-life",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.Decay = 0.99
+			cfg.DecayHalfLife = 144
+		},
+		wantErr: "DecayHalfLife",
+	}, {
+		name:    "negative success pct",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.SuccessPct = -0.1 },
+		wantErr: "SuccessPct",
+	}, {
+		name:    "success pct higher than 1",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.SuccessPct = 95 },
+		wantErr: "SuccessPct",
+	}, {
+		name:    "negative min tx count",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MinTxCount = -1 },
+		wantErr: "MinTxCount",
+	}, {
+		name:    "infinite min tx count",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.MinTxCount = math.Inf(1) },
+		wantErr: "MinTxCount",
+	}, {
+		name:    "unknown fee rate mode",
+		modify:  func(cfg *FeeEstimatorConfig) { cfg.FeeRateMode = numFeeRateModes },
+		wantErr: "FeeRateMode",
+	}, {
+		name: "bucket layout along with min bucket fee",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.BucketLayout.Pins = []dcrutil.Amount{1e5}
+		},
+		wantErr: "BucketLayout",
+	}, {
+		name: "unsorted bucket layout bounds",
+		modify: func(cfg *FeeEstimatorConfig) {
+			*cfg = FeeEstimatorConfig{MaxConfirms: 32}
+			cfg.BucketLayout.Bounds = []dcrutil.Amount{2e4, 1e4}
+		},
+		wantErr: "BucketLayout.Bounds",
+	}, {
+		name: "empty bucket layout range",
+		modify: func(cfg *FeeEstimatorConfig) {
+			*cfg = FeeEstimatorConfig{MaxConfirms: 32}
+			cfg.BucketLayout.Ranges = []BucketRange{{Min: 1e4, Max: 1e4,
+				Step: 1.1}}
+		},
+		wantErr: "BucketLayout.Ranges[0].Max",
+	}, {
+		name: "unit bucket layout range step",
+		modify: func(cfg *FeeEstimatorConfig) {
+			*cfg = FeeEstimatorConfig{MaxConfirms: 32}
+			cfg.BucketLayout.Ranges = []BucketRange{{Min: 1e4, Max: 4e5,
+				Step: 1}}
+		},
+		wantErr: "BucketLayout.Ranges[0].Step",
+	}, {
+		name: "zero bucket layout pin",
+		modify: func(cfg *FeeEstimatorConfig) {
+			*cfg = FeeEstimatorConfig{MaxConfirms: 32}
+			cfg.BucketLayout.Pins = []dcrutil.Amount{0}
+		},
+		wantErr: "BucketLayout.Pins[0]",
+	}, {
+		name: "confirm ranges along with max confirms",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.ConfirmRanges = []uint32{1, 2, 4}
+		},
+		wantErr: "ConfirmRanges",
+	}, {
+		name: "zero confirm range",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.MaxConfirms = 0
+			cfg.ConfirmRanges = []uint32{0, 2, 4}
+		},
+		wantErr: "ConfirmRanges[0]",
+	}, {
+		name: "unsorted confirm ranges",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.MaxConfirms = 0
+			cfg.ConfirmRanges = []uint32{1, 4, 4}
+		},
+		wantErr: "ConfirmRanges",
+	}, {
+		name: "confirm range beyond the tracked horizon",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.MaxConfirms = 0
+			cfg.ConfirmRanges = []uint32{1, 2, math.MaxUint32}
+		},
+		wantErr: "ConfirmRanges[2]",
+	}}
+
+	for _, test := range tests {
+		cfg := validConfig()
+		test.modify(&cfg)
+		estimator, err := NewFeeEstimator(&cfg)
+		if err == nil {
+			t.Errorf("%s: expected an error, got none", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: expected an error about %s, got %q", test.name,
+				test.wantErr, err)
+		}
+		if estimator != nil {
+			t.Errorf("%s: expected no estimator along with the error",
+				test.name)
+		}
+	}
+}
+
+// TestNewFeeEstimatorValidConfig ensures valid configs create estimators with
+// the expected parameters, using the defaults for unset ones.
+func TestNewFeeEstimatorValidConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		modify         func(cfg *FeeEstimatorConfig)
+		wantDecay      float64
+		wantSuccessPct float64
+		wantMinTxCount float64
+	}{{
+		name:           "defaults",
+		modify:         func(cfg *FeeEstimatorConfig) {},
+		wantDecay:      DefaultDecay,
+		wantSuccessPct: DefaultSuccessPct,
+		wantMinTxCount: DefaultMinTxCount,
+	}, {
+		name: "explicit tuning",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.Decay = 0.99
+			cfg.SuccessPct = 0.85
+			cfg.MinTxCount = 100
+		},
+		wantDecay:      0.99,
+		wantSuccessPct: 0.85,
+		wantMinTxCount: 100,
+	}, {
+		name: "half-life",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.DecayHalfLife = 144
+		},
+		wantDecay:      math.Pow(0.5, 1.0/144),
+		wantSuccessPct: DefaultSuccessPct,
+		wantMinTxCount: DefaultMinTxCount,
+	}, {
+		name: "minimum confirmation ranges",
+		modify: func(cfg *FeeEstimatorConfig) {
+			cfg.MaxConfirms = 2
+		},
+		wantDecay:      DefaultDecay,
+		wantSuccessPct: DefaultSuccessPct,
+		wantMinTxCount: DefaultMinTxCount,
+	}}
+
+	for _, test := range tests {
+		cfg := validConfig()
+		test.modify(&cfg)
+		estimator, err := NewFeeEstimator(&cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if estimator.decay != test.wantDecay {
+			t.Errorf("%s: expected decay %f, got %f", test.name,
+				test.wantDecay, estimator.decay)
+		}
+		if estimator.successPct != test.wantSuccessPct {
+			t.Errorf("%s: expected success pct %f, got %f", test.name,
+				test.wantSuccessPct, estimator.successPct)
+		}
+		if estimator.minTxCount != test.wantMinTxCount {
+			t.Errorf("%s: expected min tx count %f, got %f", test.name,
+				test.wantMinTxCount, estimator.minTxCount)
+		}
+		if int(estimator.maxConfirms) != int(cfg.MaxConfirms) {
+			t.Errorf("%s: expected %d confirmation ranges, got %d",
+				test.name, cfg.MaxConfirms, estimator.maxConfirms)
+		}
+
+		// the buckets must be strictly increasing and end at +Inf
+		bounds := estimator.bucketFeeBounds
+		if len(bounds) < 2 || !math.IsInf(float64(bounds[len(bounds)-1]), 1) {
+			t.Errorf("%s: unexpected bucket bounds %v", test.name, bounds)
+			continue
+		}
+		for i := 1; i < len(bounds); i++ {
+			if bounds[i] <= bounds[i-1] {
+				t.Errorf("%s: bucket bounds not increasing at %d: %v",
+					test.name, i, bounds)
+				break
+			}
+		}
+
+		// the estimator must survive new blocks with the minimum number of
+		// confirmation ranges
+		estimator.SetBestHeight(0)
+		estimator.ProcessMinedTransactions(1, nil)
+	}
+}
+
+// TestMemPoolInconsistency ensures an inconsistency in the mempool stats is
+// reported to the handler and recovered from by resyncing the stats, instead of
+// taking down the caller.
+func TestMemPoolInconsistency(t *testing.T) {
+	cfg := validConfig()
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var reported []error
+	estimator.SetInconsistencyHandler(func(err error) {
+		reported = append(reported, err)
+	})
+
+	// track two txs in the same bucket, one of them for an extra block
+	estimator.SetBestHeight(10)
+	hash1, hash2 := chainhash.Hash{1}, chainhash.Hash{2}
+	estimator.AddMemPoolTransaction(&hash1, 20000, 1000)
+	estimator.ProcessMinedTransactions(11, nil)
+	estimator.AddMemPoolTransaction(&hash2, 20000, 1000)
+	bucket := estimator.lowerBucket(2e4)
+	memPool := &estimator.memPool[bucket]
+
+	// simulate the stats drifting from the tracked txs, so that removing the
+	// first tx makes its count negative
+	memPool.confirmed[1] = txConfirmStatBucketCount{}
+	memPool.confirmed[0].txCount = 5
+	estimator.RemoveMemPoolTransaction(&hash1)
+
+	if len(reported) != 1 {
+		t.Fatalf("expected 1 reported inconsistency, got %d", len(reported))
+	}
+	e, ok := reported[0].(ErrMemPoolInconsistency)
+	if !ok {
+		t.Fatalf("unexpected error type %T", reported[0])
+	}
+	if e.BucketIndex != bucket || e.ConfirmIndex != 1 {
+		t.Errorf("unexpected inconsistency location %d/%d", e.BucketIndex,
+			e.ConfirmIndex)
+	}
+
+	// the stats must have been resynced to only account for the second tx
+	for b := range estimator.memPool {
+		for c, conf := range estimator.memPool[b].confirmed {
+			want := float64(0)
+			if b == int(bucket) && c == 0 {
+				want = 1
+			}
+			if conf.txCount != want {
+				t.Errorf("expected %f txs in bucket %d range %d, got %f",
+					want, b, c, conf.txCount)
+			}
+		}
+	}
+
+	// and the second tx can be mined normally
+	reported = nil
+	estimator.ProcessMinedTransactions(12, []*chainhash.Hash{&hash2})
+	if len(reported) != 0 {
+		t.Errorf("unexpected inconsistencies after resync: %v", reported)
+	}
+	mined := estimator.Snapshot().Buckets[bucket].ConfirmCount
+	if math.Abs(mined-1) > 1e-9 {
+		t.Errorf("expected the tx to be mined, got %f mined txs", mined)
+	}
+}
+
+// TestCheckMemPool ensures mismatches between the mempool stats and the tracked
+// mempool txs are detected and repaired.
+func TestCheckMemPool(t *testing.T) {
+	cfg := validConfig()
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	estimator.SetBestHeight(10)
+	for i := byte(0); i < 10; i++ {
+		hash := chainhash.Hash{i}
+		estimator.AddMemPoolTransaction(&hash, 10000+int64(i)*1000, 1000)
+		estimator.ProcessMinedTransactions(11+int64(i), nil)
+	}
+	if err := estimator.CheckMemPool(1e-6, false); err != nil {
+		t.Fatalf("unexpected mismatch in consistent stats: %v", err)
+	}
+
+	// counts within the tolerance are not reported
+	bucket := estimator.lowerBucket(15000)
+	conf := &estimator.memPool[bucket].confirmed[5]
+	conf.txCount += 1e-9
+	if err := estimator.CheckMemPool(1e-6, false); err != nil {
+		t.Fatalf("unexpected mismatch within tolerance: %v", err)
+	}
+
+	conf.txCount++
+	err = estimator.CheckMemPool(1e-6, false)
+	e, ok := err.(ErrMemPoolMismatch)
+	if !ok {
+		t.Fatalf("expected an ErrMemPoolMismatch, got %v", err)
+	}
+	if len(e.Mismatches) != 1 || e.Mismatches[0].BucketIndex != bucket ||
+		e.Mismatches[0].ConfirmIndex != 5 {
+		t.Fatalf("unexpected mismatches %+v", e.Mismatches)
+	}
+
+	// the mismatch is kept unless repaired
+	if err := estimator.CheckMemPool(1e-6, false); err == nil {
+		t.Fatalf("expected the mismatch to be kept")
+	}
+	if err := estimator.CheckMemPool(1e-6, true); err == nil {
+		t.Fatalf("expected the mismatch to be reported when repairing")
+	}
+	if err := estimator.CheckMemPool(1e-6, false); err != nil {
+		t.Fatalf("unexpected mismatch after repairing: %v", err)
+	}
+
+	// a drift in the cohorts that move the txs between confirmation ranges
+	// shows up once they are moved, and repairing it must also fix the
+	// cohorts so that the following moves don't bring it back
+	cohort := estimator.memPoolCohorts[estimator.bestHeight+1][0]
+	for b, count := range cohort.counts {
+		count.txCount++
+		cohort.counts[b] = count
+		break
+	}
+	estimator.ProcessMinedTransactions(estimator.bestHeight+1, nil)
+	if err := estimator.CheckMemPool(1e-6, true); err == nil {
+		t.Fatalf("expected the cohort drift to be reported")
+	}
+	for i := 0; i < 5; i++ {
+		estimator.ProcessMinedTransactions(estimator.bestHeight+1, nil)
+		if err := estimator.CheckMemPool(1e-6, false); err != nil {
+			t.Fatalf("unexpected mismatch %d blocks after repairing the "+
+				"cohorts: %v", i+1, err)
+		}
+	}
+}
+
+// TestSetBestHeight ensures changing the best height while txs are tracked
+// (eg, after a reorg) keeps the mempool stats consistent with the tracked txs
+// on the following blocks.
+func TestSetBestHeight(t *testing.T) {
+	cfg := validConfig()
+	cfg.MaxConfirms = 0
+	cfg.ConfirmRanges = []uint32{2, 4, 8}
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	estimator.SetBestHeight(10)
+	for i := byte(0); i < 5; i++ {
+		hash := chainhash.Hash{i}
+		estimator.AddMemPoolTransaction(&hash, 10000+int64(i)*1000, 1000)
+		estimator.ProcessMinedTransactions(11+int64(i), nil)
+	}
+
+	for _, height := range []int64{20, 12, 13} {
+		estimator.SetBestHeight(height)
+		for i := 0; i < 10; i++ {
+			if err := estimator.CheckMemPool(1e-6, false); err != nil {
+				t.Fatalf("unexpected mismatch %d blocks after setting "+
+					"the best height to %d: %v", i, height, err)
+			}
+			estimator.ProcessMinedTransactions(estimator.bestHeight+1, nil)
+		}
+	}
+}
+
+// TestSnapshot ensures the snapshot reflects the state of the estimator and can
+// be rendered as JSON despite the infinite upper bound of the last bucket.
+func TestSnapshot(t *testing.T) {
+	cfg := validConfig()
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	estimator.SetBestHeight(10)
+	hash1, hash2 := chainhash.Hash{1}, chainhash.Hash{2}
+	estimator.AddMemPoolTransaction(&hash1, 20000, 1000)
+	estimator.AddMemPoolTransaction(&hash2, 30000, 1000)
+	estimator.ProcessMinedTransactions(12, nil)
+	estimator.ProcessMinedTransactions(13, []*chainhash.Hash{&hash1})
+
+	snap := estimator.Snapshot()
+	if snap.BestHeight != 13 || snap.MemPoolTxs != 1 ||
+		snap.MaxConfirms != int32(cfg.MaxConfirms) {
+		t.Fatalf("unexpected snapshot header %+v", snap)
+	}
+	if len(snap.Buckets) != len(estimator.bucketFeeBounds) {
+		t.Fatalf("expected %d buckets, got %d", len(estimator.bucketFeeBounds),
+			len(snap.Buckets))
+	}
+
+	// the first tx was mined after 3 blocks and the second one has been in the
+	// mempool for 3 blocks
+	mined := snap.Buckets[estimator.lowerBucket(20000)]
+	if mined.ConfirmCount != 1 || mined.AvgFeeRate != 20000 {
+		t.Errorf("unexpected mined bucket %+v", mined)
+	}
+	if mined.Confirmed[1].TxCount != 0 || mined.Confirmed[2].TxCount != 1 ||
+		mined.Confirmed[2].AvgFeeRate != 20000 {
+		t.Errorf("unexpected confirmation ranges %+v", mined.Confirmed[:3])
+	}
+	memPool := snap.Buckets[estimator.lowerBucket(30000)]
+	if memPool.MemPool[3].TxCount != 1 || memPool.MemPool[3].AvgFeeRate != 30000 {
+		t.Errorf("unexpected mempool ranges %+v", memPool.MemPool[:4])
+	}
+
+	// the snapshot is a copy
+	estimator.ProcessMinedTransactions(14, []*chainhash.Hash{&hash2})
+	if snap.MemPoolTxs != 1 || memPool.ConfirmCount != 0 {
+		t.Errorf("snapshot changed along with the estimator")
+	}
+	snap.ConfirmRanges[0] = 1000
+	if estimator.confirmBounds[0] != 1 {
+		t.Errorf("estimator changed along with the snapshot")
+	}
+
+	b, err := snap.JSON()
+	if err != nil {
+		t.Fatalf("unable to render snapshot as JSON: %v", err)
+	}
+	var decoded struct {
+		Buckets []struct {
+			UpperBound *float64 `json:"upperBound"`
+		} `json:"buckets"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("unable to decode snapshot JSON: %v", err)
+	}
+	last := len(decoded.Buckets) - 1
+	if decoded.Buckets[last].UpperBound != nil {
+		t.Errorf("expected a null upper bound for the last bucket, got %f",
+			*decoded.Buckets[last].UpperBound)
+	}
+	if decoded.Buckets[0].UpperBound == nil || *decoded.Buckets[0].UpperBound != 1e4 {
+		t.Errorf("unexpected upper bound for the first bucket")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(snap.Text(), "\n"), "\n")
+	if len(lines) != len(snap.Buckets)+1 {
+		t.Errorf("expected %d lines of text, got %d", len(snap.Buckets)+1,
+			len(lines))
+	}
+}
+
+// TestFeeRateModes ensures the fee rate of txs is computed according to the
+// configured mode, including the truncation done by the default downsampled
+// mode.
+func TestFeeRateModes(t *testing.T) {
+	tests := []struct {
+		name      string
+		fee, size int64
+		want      [numFeeRateModes]feeRate
+	}{{
+		name: "exact multiple",
+		fee:  10000, size: 1000,
+		want: [numFeeRateModes]feeRate{10000, 10000, 10000, 10000},
+	}, {
+		name: "fraction of atom/byte",
+		fee:  10999, size: 1000,
+		want: [numFeeRateModes]feeRate{10000, 10999, 10999, 10999},
+	}, {
+		name: "fraction of atom/KB",
+		fee:  1001, size: 300,
+		want: [numFeeRateModes]feeRate{3000, 3336, 3337, 3337},
+	}, {
+		name: "half atom/KB",
+		fee:  1, size: 2000,
+		want: [numFeeRateModes]feeRate{0, 0, 1, 1},
+	}, {
+		name: "below 1 atom/byte",
+		fee:  150, size: 250,
+		want: [numFeeRateModes]feeRate{0, 600, 600, 600},
+	}, {
+		name: "below 1 atom/byte with fraction",
+		fee:  100, size: 300,
+		want: [numFeeRateModes]feeRate{0, 333, 333, 334},
+	}, {
+		name: "zero fee",
+		fee:  0, size: 250,
+		want: [numFeeRateModes]feeRate{0, 0, 0, 0},
+	}}
+
+	for _, test := range tests {
+		for m := FeeRateMode(0); m < numFeeRateModes; m++ {
+			got := m.txFeeRate(test.fee, test.size)
+			if got != test.want[m] {
+				t.Errorf("%s (%s): expected %.0f, got %.0f", test.name, m,
+					test.want[m], got)
+			}
+		}
+	}
+}
+
+// TestExactFeeRateTracking ensures txs paying less than 1 atom/byte are only
+// tracked by the estimator when using an exact fee rate mode.
+func TestExactFeeRateTracking(t *testing.T) {
+	for m := FeeRateMode(0); m < numFeeRateModes; m++ {
+		cfg := validConfig()
+		cfg.MinBucketFee = 100
+		cfg.FeeRateMode = m
+		estimator, err := NewFeeEstimator(&cfg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", m, err)
+		}
+		hash := chainhash.Hash{1}
+		estimator.AddMemPoolTransaction(&hash, 150, 250)
+
+		wantTracked := m != FeeRateDownsampled
+		if _, tracked := estimator.memPoolTxs[hash]; tracked != wantTracked {
+			t.Errorf("%s: expected tracked=%v", m, wantTracked)
+		}
+	}
+}
+
+// TestBucketLayout ensures the layout defined by MinBucketFee, MaxBucketFee and
+// FeeRateStep matches the original algorithm (including the bucket at 0.001
+// DCR/KB) and that explicit layouts merge their bounds, ranges and pins.
+func TestBucketLayout(t *testing.T) {
+	// legacyBounds is the original algorithm of NewFeeEstimator
+	legacyBounds := func(cfg *FeeEstimatorConfig) []feeRate {
+		var res []feeRate
+		prevF := 0.0
+		for f := float64(cfg.MinBucketFee); f < float64(cfg.MaxBucketFee); f *= cfg.FeeRateStep {
+			if (f > 1e5) && (prevF < 1e5) {
+				res = append(res, feeRate(1e5))
+			}
+			res = append(res, feeRate(f))
+			prevF = f
+		}
+		return append(res, feeRate(math.Inf(1)))
+	}
+
+	for _, tc := range testCases {
+		cfg := tc.estCfg
+		if !cfg.BucketLayout.isEmpty() {
+			continue
+		}
+		bounds, _ := cfg.bucketLayout()
+		want := legacyBounds(&cfg)
+		if len(bounds) != len(want) {
+			t.Fatalf("%+v: expected %d buckets, got %d", cfg, len(want),
+				len(bounds))
+		}
+		for i := range want {
+			if bounds[i] != want[i] {
+				t.Fatalf("%+v: expected bound %d to be %v, got %v", cfg, i,
+					want[i], bounds[i])
+			}
+		}
+	}
+
+	cfg := FeeEstimatorConfig{
+		MaxConfirms: 32,
+		BucketLayout: BucketLayout{
+			Bounds: []dcrutil.Amount{1e4, 2e4},
+			Ranges: []BucketRange{{Min: 2e4, Max: 5e4, Step: 1.5}},
+			Pins:   []dcrutil.Amount{1.5e4, 2e4},
+		},
+	}
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []feeRate{1e4, 1.5e4, 2e4, 3e4, 4.5e4, feeRate(math.Inf(1))}
+	if len(estimator.bucketFeeBounds) != len(want) {
+		t.Fatalf("expected bounds %v, got %v", want, estimator.bucketFeeBounds)
+	}
+	for i := range want {
+		if estimator.bucketFeeBounds[i] != want[i] {
+			t.Fatalf("expected bounds %v, got %v", want,
+				estimator.bucketFeeBounds)
+		}
+	}
+	if len(estimator.pinnedFees) != 2 {
+		t.Fatalf("unexpected pinned fees %v", estimator.pinnedFees)
+	}
+}
+
+// TestSaveLoadFeeEstimator ensures a saved estimator is loaded back with the
+// same statistics and mempool txs, and that its statistics are moved to the
+// new buckets when loaded with a different layout.
+func TestSaveLoadFeeEstimator(t *testing.T) {
+	cfg := validConfig()
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	estimator.SetBestHeight(10)
+	for i := byte(0); i < 20; i++ {
+		hash := chainhash.Hash{i}
+		estimator.AddMemPoolTransaction(&hash, 10000+int64(i)*2000, 1000)
+		if i%2 == 0 {
+			estimator.ProcessMinedTransactions(11+int64(i),
+				[]*chainhash.Hash{&hash})
+		}
+	}
+
+	// saving doesn't change the estimator
+	scale := estimator.decayScale
+	before := estimator.buckets[estimator.lowerBucket(2e4)]
+	var buf bytes.Buffer
+	if err := estimator.Save(&buf); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	saved := buf.String()
+	after := estimator.buckets[estimator.lowerBucket(2e4)]
+	if scale == 1 || estimator.decayScale != scale ||
+		after.confirmCount != before.confirmCount ||
+		after.confirmed[0] != before.confirmed[0] {
+		t.Fatalf("saving changed the estimator (decay scale %g, was %g)",
+			estimator.decayScale, scale)
+	}
+
+	// saving again gives the same output
+	var again bytes.Buffer
+	if err := estimator.Save(&again); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if again.String() != saved {
+		t.Fatalf("saving the same estimator twice gave different output")
+	}
+
+	loaded, err := LoadFeeEstimator(&cfg, strings.NewReader(saved))
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if loaded.Snapshot().Text() != estimator.Snapshot().Text() {
+		t.Fatalf("loaded estimator differs from the saved one")
+	}
+	if len(loaded.memPoolTxs) != len(estimator.memPoolTxs) {
+		t.Fatalf("expected %d mempool txs, got %d",
+			len(estimator.memPoolTxs), len(loaded.memPoolTxs))
+	}
+	if err := loaded.CheckMemPool(1e-6, false); err != nil {
+		t.Fatalf("unexpected mempool mismatch: %v", err)
+	}
+	// the saved stats are the decayed ones, so the estimates may differ by
+	// rounding
+	want, _ := estimator.EstimateFee(2)
+	if got, _ := loaded.EstimateFee(2); got < want-1 || got > want+1 {
+		t.Fatalf("expected estimate %v, got %v", want, got)
+	}
+
+	// load into a coarser layout
+	coarse := FeeEstimatorConfig{
+		MaxConfirms: cfg.MaxConfirms,
+		BucketLayout: BucketLayout{
+			Ranges: []BucketRange{{Min: 1e4, Max: 4e5, Step: 2}},
+		},
+	}
+	loaded, err = LoadFeeEstimator(&coarse, strings.NewReader(saved))
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	var wantCount, gotCount float64
+	for b := range estimator.buckets {
+		wantCount += estimator.buckets[b].confirmCount * estimator.decayScale
+	}
+	for b := range loaded.buckets {
+		gotCount += loaded.buckets[b].confirmCount * loaded.decayScale
+	}
+	if math.Abs(gotCount-wantCount) > 1e-9 {
+		t.Fatalf("expected %f confirmed txs, got %f", wantCount, gotCount)
+	}
+	if err := loaded.CheckMemPool(1e-6, false); err != nil {
+		t.Fatalf("unexpected mempool mismatch: %v", err)
+	}
+
+	// the confirmation ranges can't be remapped
+	cfg.MaxConfirms = 16
+	if _, err := LoadFeeEstimator(&cfg, strings.NewReader(saved)); err == nil {
+		t.Fatalf("expected an error loading with different MaxConfirms")
+	}
+}
+
+// TestConfirmRanges ensures the confirmation ranges defined by MaxConfirms
+// track each number of blocks, grouped ranges map the number of blocks and
+// targets to the expected ranges, and the mempool stats are kept consistent as
+// txs move through grouped ranges.
+func TestConfirmRanges(t *testing.T) {
+	cfg := validConfig()
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for blocks := int32(1); blocks <= 40; blocks++ {
+		want := blocks - 1
+		if want > 31 {
+			want = 31
+		}
+		if c := estimator.confirmRange(blocks); c != want {
+			t.Fatalf("expected range %d for %d blocks, got %d", want,
+				blocks, c)
+		}
+		if blocks > 32 {
+			continue
+		}
+		if c := estimator.targetRange(blocks); c != want {
+			t.Fatalf("expected range %d for target %d, got %d", want,
+				blocks, c)
+		}
+	}
+
+	cfg.MaxConfirms = 0
+	cfg.ConfirmRanges = []uint32{2, 4, 8}
+	estimator, err = NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		blocks      int32
+		wantConfirm int32
+		wantTarget  int32
+	}{
+		{blocks: 1, wantConfirm: 0, wantTarget: -1},
+		{blocks: 2, wantConfirm: 0, wantTarget: 0},
+		{blocks: 3, wantConfirm: 1, wantTarget: 0},
+		{blocks: 4, wantConfirm: 1, wantTarget: 1},
+		{blocks: 7, wantConfirm: 2, wantTarget: 1},
+		{blocks: 8, wantConfirm: 2, wantTarget: 2},
+		{blocks: 9, wantConfirm: 3, wantTarget: 3},
+	}
+	for _, test := range tests {
+		if c := estimator.confirmRange(test.blocks); c != test.wantConfirm {
+			t.Errorf("expected range %d for %d blocks, got %d",
+				test.wantConfirm, test.blocks, c)
+		}
+		if test.wantTarget < 0 {
+			// no range ensures the txs were confirmed within the target
+			_, err := estimator.EstimateFee(test.blocks)
+			if err != ErrTargetConfTooLow {
+				t.Errorf("expected ErrTargetConfTooLow for target %d, "+
+					"got %v", test.blocks, err)
+			}
+			continue
+		}
+		if c := estimator.targetRange(test.blocks); c != test.wantTarget {
+			t.Errorf("expected range %d for target %d, got %d",
+				test.wantTarget, test.blocks, c)
+		}
+	}
+
+	// add txs on every block, mining and removing some of them
+	estimator.SetBestHeight(0)
+	var hashes []chainhash.Hash
+	for height := int64(1); height <= 30; height++ {
+		var mined []*chainhash.Hash
+		for i := 0; i < len(hashes); i += 3 {
+			mined = append(mined, &hashes[i])
+		}
+		estimator.ProcessMinedTransactions(height, mined)
+		if len(hashes) > 1 {
+			estimator.RemoveMemPoolTransaction(&hashes[1])
+		}
+		for i := byte(0); i < 5; i++ {
+			hash := chainhash.Hash{byte(height), i}
+			hashes = append(hashes, hash)
+			estimator.AddMemPoolTransaction(&hash, 10000+int64(i)*5000, 1000)
+		}
+		if err := estimator.CheckMemPool(1e-6, false); err != nil {
+			t.Fatalf("unexpected mismatch at height %d: %v", height, err)
+		}
+	}
+	var lastRange float64
+	for b := range estimator.memPool {
+		lastRange += estimator.memPool[b].confirmed[3].txCount
+	}
+	if lastRange == 0 {
+		t.Fatalf("expected txs in the last confirmation range")
+	}
+
+	// only the cohorts of txs not yet in the last range are tracked, keyed by
+	// the height they reach the bound of their range
+	for height, cohorts := range estimator.memPoolCohorts {
+		for _, cohort := range cohorts {
+			bound := int64(estimator.confirmBounds[cohort.confirmIdx])
+			if height <= estimator.bestHeight ||
+				cohort.addedHeight+bound != height {
+				t.Fatalf("unexpected cohort of height %d in range %d "+
+					"scheduled at height %d", cohort.addedHeight,
+					cohort.confirmIdx, height)
+			}
+		}
+	}
+	if len(estimator.memPoolCohorts) > 8 {
+		t.Fatalf("expected at most 8 scheduled heights, got %d",
+			len(estimator.memPoolCohorts))
+	}
+}
+
+// TestOpenEndedEstimate ensures targets beyond the tracked confirmation ranges
+// are estimated using the last range and flagged as open-ended.
+func TestOpenEndedEstimate(t *testing.T) {
+	cfg := validConfig()
+	cfg.MaxConfirms = 4
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// txs are mined 6 blocks after being published, which is past the
+	// tracked ranges
+	estimator.SetBestHeight(0)
+	var hashes []chainhash.Hash
+	for height := int64(1); height <= 200; height++ {
+		var mined []*chainhash.Hash
+		if height > 6 {
+			for i := 0; i < 10; i++ {
+				mined = append(mined, &hashes[(height-7)*10+int64(i)])
+			}
+		}
+		estimator.ProcessMinedTransactions(height, mined)
+		for i := byte(0); i < 10; i++ {
+			hash := chainhash.Hash{byte(height), i}
+			hashes = append(hashes, hash)
+			estimator.AddMemPoolTransaction(&hash, 10000+int64(i)*1000, 1000)
+		}
+	}
+
+	if _, err := estimator.EstimateFeeTarget(3, EstimateMedian); err == nil {
+		t.Fatalf("expected an error estimating within the tracked ranges")
+	}
+	want, err := estimator.EstimateFeeTarget(4, EstimateMedian)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, target := range []int32{4, 5, 288, 1000} {
+		est, err := estimator.EstimateFeeTarget(target, EstimateMedian)
+		if err != nil {
+			t.Fatalf("target %d: unexpected error: %v", target, err)
+		}
+		if !est.OpenEnded || est.TargetConfs != target {
+			t.Fatalf("target %d: unexpected estimate %+v", target, est)
+		}
+		if est.FeeRate != want.FeeRate {
+			t.Fatalf("target %d: expected fee rate %v, got %v", target,
+				want.FeeRate, est.FeeRate)
+		}
+	}
+
+	// the open-ended estimate is selected by the mode from the passing range
+	// of buckets of the last range: the median of its confirmed txs by
+	// default, and its lowest fee rate with EstimateLowerBound
+	sparse := fixtureEstimator(t, []dcrutil.Amount{1e4, 2e4, 3e4, 4e4},
+		[]uint32{1, 2, 3}, map[int]fixtureBucket{
+			1: {confirmed: []float64{0, 0, 0, 0.4}, avgFeeRate: 15000},
+			2: {confirmed: []float64{0, 0, 0, 0.4}, avgFeeRate: 25000},
+			3: {confirmed: []float64{0, 0, 0, 0.8}, avgFeeRate: 35000},
+		})
+	for mode, want := range map[EstimateMode]dcrutil.Amount{
+		EstimateMedian:     35000,
+		EstimateLowerBound: 20001,
+	} {
+		est, err := sparse.EstimateFeeTarget(4, mode)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+		if !est.OpenEnded || est.FeeRate != want {
+			t.Fatalf("%s: expected an open-ended estimate of %v, got %+v",
+				mode, want, est)
+		}
+	}
+	if got, _ := sparse.EstimateFee(288); got != 35000 {
+		t.Fatalf("expected the open-ended median 35000, got %v", got)
+	}
+
+	// targets lower than 1 block are rejected
+	for _, target := range []int32{0, -1, math.MinInt32} {
+		if _, err := estimator.EstimateFee(target); err != ErrTargetConfTooLow {
+			t.Fatalf("target %d: expected ErrTargetConfTooLow, got %v",
+				target, err)
+		}
+		_, err := estimator.EstimateFeeTarget(target, EstimateP90)
+		if err != ErrTargetConfTooLow {
+			t.Fatalf("target %d: expected ErrTargetConfTooLow, got %v",
+				target, err)
+		}
+	}
+}
+
+// TestLazyDecay ensures the recorded statistics decay by the configured factor
+// on every block, including across renormalizations of the decay scale.
+func TestLazyDecay(t *testing.T) {
+	cfg := validConfig()
+	cfg.Decay = 0.5
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// mine a tx on every block, 1 block after being published
+	var want float64
+	renormalized := false
+	estimator.SetBestHeight(0)
+	for height := int64(1); height <= 400; height++ {
+		hash := chainhash.Hash{byte(height), byte(height >> 8)}
+		estimator.AddMemPoolTransaction(&hash, 20000, 1000)
+		scale := estimator.decayScale
+		estimator.ProcessMinedTransactions(height, []*chainhash.Hash{&hash})
+		renormalized = renormalized || estimator.decayScale > scale
+		want = want*cfg.Decay + 1
+
+		got := estimator.Snapshot().Buckets[estimator.lowerBucket(2e4)].ConfirmCount
+		if math.Abs(got-want) > want*1e-9 {
+			t.Fatalf("expected %f mined txs at height %d, got %f", want,
+				height, got)
+		}
+	}
+	if !renormalized {
+		t.Fatalf("expected the decay scale to be renormalized")
+	}
+}
+
+// fixtureBucket holds the mined txs of a fee rate bucket of a fixture
+// estimator: the number of txs confirmed within each confirmation range (which
+// is cumulative, as recorded by the estimator) and their average fee rate.
+type fixtureBucket struct {
+	confirmed  []float64
+	avgFeeRate float64
+}
+
+// fixtureEstimator returns an estimator with fee rate buckets bounded by the
+// given fee rates (plus the last +Inf one) and the given confirmation ranges,
+// holding the given mined txs on each bucket.
+func fixtureEstimator(t *testing.T, bounds []dcrutil.Amount, ranges []uint32,
+	buckets map[int]fixtureBucket) *FeeEstimator {
+
+	cfg := FeeEstimatorConfig{
+		ConfirmRanges: ranges,
+		BucketLayout:  BucketLayout{Bounds: bounds},
+	}
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for b, fb := range buckets {
+		bucket := &estimator.buckets[b]
+		for c, n := range fb.confirmed {
+			bucket.confirmed[c] = txConfirmStatBucketCount{
+				txCount: n,
+				feeSum:  n * fb.avgFeeRate,
+			}
+		}
+		bucket.confirmCount = fb.confirmed[len(fb.confirmed)-1]
+		bucket.feeSum = bucket.confirmCount * fb.avgFeeRate
+	}
+	return estimator
+}
+
+// TestConfirmationProbability ensures the probabilities of confirming a fee
+// rate within each confirmation range and the expected number of blocks are
+// computed from the stats of its bucket, grouping sparse buckets and counting
+// the mempool txs as not confirmed.
+func TestConfirmationProbability(t *testing.T) {
+	bounds := []dcrutil.Amount{1e4, 2e4, 3e4}
+	tests := []struct {
+		name         string
+		ranges       []uint32
+		buckets      map[int]fixtureBucket
+		memPool      []float64
+		rate         dcrutil.Amount
+		wantProbs    []float64
+		wantExpected float64
+		wantErr      error
+	}{{
+		name:   "bucket with data",
+		ranges: []uint32{1, 2, 3},
+		buckets: map[int]fixtureBucket{
+			2: {confirmed: []float64{2, 5, 8, 10}, avgFeeRate: 25000},
+		},
+		rate:         25000,
+		wantProbs:    []float64{0.2, 0.5, 0.8, 1},
+		wantExpected: 2.5,
+	}, {
+		name:   "fast bucket",
+		ranges: []uint32{1, 2, 3},
+		buckets: map[int]fixtureBucket{
+			2: {confirmed: []float64{2, 5, 8, 10}, avgFeeRate: 25000},
+			3: {confirmed: []float64{9, 10, 10, 10}, avgFeeRate: 40000},
+		},
+		rate:         50000,
+		wantProbs:    []float64{0.9, 1, 1, 1},
+		wantExpected: 1.1,
+	}, {
+		name:   "empty buckets grouped with a higher one",
+		ranges: []uint32{1, 2, 3},
+		buckets: map[int]fixtureBucket{
+			2: {confirmed: []float64{2, 5, 8, 10}, avgFeeRate: 25000},
+		},
+		rate:         15000,
+		wantProbs:    []float64{0.2, 0.5, 0.8, 1},
+		wantExpected: 2.5,
+	}, {
+		name:   "mempool txs count as not confirmed",
+		ranges: []uint32{1, 2, 3},
+		buckets: map[int]fixtureBucket{
+			2: {confirmed: []float64{2, 5, 8, 10}, avgFeeRate: 25000},
+		},
+		memPool:      []float64{0, 10, 0, 0},
+		rate:         25000,
+		wantProbs:    []float64{0.2, 0.25, 0.8, 1},
+		wantExpected: 2.75,
+	}, {
+		name:   "grouped confirmation ranges",
+		ranges: []uint32{2, 4},
+		buckets: map[int]fixtureBucket{
+			2: {confirmed: []float64{4, 8, 10}, avgFeeRate: 25000},
+		},
+		rate:         25000,
+		wantProbs:    []float64{0.4, 0.8, 1},
+		wantExpected: 3.4,
+	}, {
+		name:   "not enough txs",
+		ranges: []uint32{1, 2, 3},
+		buckets: map[int]fixtureBucket{
+			2: {confirmed: []float64{0, 0, 0.5, 0.5}, avgFeeRate: 25000},
+		},
+		rate:    25000,
+		wantErr: ErrNotEnoughTxsForEstimate,
+	}, {
+		name:    "below the minimum fee rate",
+		ranges:  []uint32{1, 2, 3},
+		rate:    5000,
+		wantErr: ErrFeeRateTooLow,
+	}}
+
+	for _, test := range tests {
+		estimator := fixtureEstimator(t, bounds, test.ranges, test.buckets)
+		for c, n := range test.memPool {
+			estimator.memPool[2].confirmed[c].txCount = n
+		}
+		est, err := estimator.ConfirmationProbability(test.rate)
+		if err != test.wantErr {
+			t.Errorf("%s: expected error %v, got %v", test.name,
+				test.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(est.SuccessPct) != len(test.wantProbs) {
+			t.Errorf("%s: expected probabilities %v, got %v", test.name,
+				test.wantProbs, est.SuccessPct)
+			continue
+		}
+		for c, want := range test.wantProbs {
+			if math.Abs(est.SuccessPct[c]-want) > 1e-9 {
+				t.Errorf("%s: expected probabilities %v, got %v",
+					test.name, test.wantProbs, est.SuccessPct)
+				break
+			}
+		}
+		if math.Abs(est.ExpectedBlocks-test.wantExpected) > 1e-9 {
+			t.Errorf("%s: expected %f blocks, got %f", test.name,
+				test.wantExpected, est.ExpectedBlocks)
+		}
+		if len(est.ConfirmRanges) != len(test.ranges) {
+			t.Errorf("%s: unexpected confirmation ranges %v", test.name,
+				est.ConfirmRanges)
+			continue
+		}
+
+		// the returned ranges are a copy
+		est.ConfirmRanges[0] = 1000
+		if estimator.confirmBounds[0] != int32(test.ranges[0]) {
+			t.Errorf("%s: the estimator ranges changed along with the "+
+				"returned ones", test.name)
+		}
+	}
+}
+
+// TestEstimateModes ensures each estimate mode selects the expected fee rate
+// from the passing range of buckets, interpolating percentiles within their
+// bucket and returning a lower bound that falls into the range.
+func TestEstimateModes(t *testing.T) {
+	bounds := []dcrutil.Amount{1e4, 2e4, 3e4, 4e4}
+	tests := []struct {
+		name    string
+		buckets map[int]fixtureBucket
+		want    [numEstimateModes]feeRate
+	}{{
+		name: "single passing bucket",
+		buckets: map[int]fixtureBucket{
+			1: {confirmed: []float64{1, 5, 10, 10}, avgFeeRate: 15000},
+			2: {confirmed: []float64{10, 10, 10, 10}, avgFeeRate: 25000},
+			3: {confirmed: []float64{10, 10, 10, 10}, avgFeeRate: 35000},
+		},
+		want: [numEstimateModes]feeRate{
+			EstimateMedian:     25000,
+			EstimateP10:        21000,
+			EstimateP25:        22500,
+			EstimateP75:        27500,
+			EstimateP90:        29000,
+			EstimateLowerBound: 20001,
+		},
+	}, {
+		name: "range of sparse buckets",
+		buckets: map[int]fixtureBucket{
+			1: {confirmed: []float64{1, 5, 10, 10}, avgFeeRate: 15000},
+			2: {confirmed: []float64{0.4, 0.4, 0.4, 0.4}, avgFeeRate: 25000},
+			3: {confirmed: []float64{0.8, 0.8, 0.8, 0.8}, avgFeeRate: 35000},
+		},
+		want: [numEstimateModes]feeRate{
+			EstimateMedian:     35000,
+			EstimateP10:        23000,
+			EstimateP25:        27500,
+			EstimateP75:        36250,
+			EstimateP90:        38500,
+			EstimateLowerBound: 20001,
+		},
+	}, {
+		name: "last bucket",
+		buckets: map[int]fixtureBucket{
+			3: {confirmed: []float64{1, 5, 10, 10}, avgFeeRate: 35000},
+			4: {confirmed: []float64{2, 2, 2, 2}, avgFeeRate: 50000},
+		},
+		want: [numEstimateModes]feeRate{
+			EstimateMedian:     50000,
+			EstimateP10:        42000,
+			EstimateP25:        45000,
+			EstimateP75:        50000,
+			EstimateP90:        50000,
+			EstimateLowerBound: 40001,
+		},
+	}, {
+		name: "first bucket",
+		buckets: map[int]fixtureBucket{
+			0: {confirmed: []float64{5, 5, 5, 5}, avgFeeRate: 10000},
+		},
+		want: [numEstimateModes]feeRate{
+			EstimateMedian:     10000,
+			EstimateP10:        10000,
+			EstimateP25:        10000,
+			EstimateP75:        10000,
+			EstimateP90:        10000,
+			EstimateLowerBound: 10000,
+		},
+	}}
+
+	for _, test := range tests {
+		estimator := fixtureEstimator(t, bounds, []uint32{1, 2, 3},
+			test.buckets)
+		for m := EstimateMode(0); m < numEstimateModes; m++ {
+			got, err := estimator.EstimateFeeMode(1, m)
+			if err != nil {
+				t.Errorf("%s (%s): unexpected error: %v", test.name, m, err)
+				continue
+			}
+			if math.Abs(float64(got)-float64(test.want[m])) > 1e-6 {
+				t.Errorf("%s (%s): expected %.0f, got %v", test.name, m,
+					test.want[m], int64(got))
+			}
+		}
+	}
+
+	// unknown modes are rejected (and can still be formatted)
+	estimator := fixtureEstimator(t, bounds, []uint32{1, 2, 3},
+		tests[0].buckets)
+	for _, m := range []EstimateMode{-1, numEstimateModes} {
+		if _, err := estimator.EstimateFeeMode(1, m); err == nil {
+			t.Errorf("mode %d: expected an error", int(m))
+		}
+		if _, err := estimator.EstimateFeeTarget(1, m); err == nil {
+			t.Errorf("mode %d: expected an error from EstimateFeeTarget",
+				int(m))
+		}
+		if s := m.String(); s != "unknown" {
+			t.Errorf("mode %d: expected to be formatted as unknown, got %q",
+				int(m), s)
+		}
+	}
+}
+
+// TestLoadFeeEstimatorRelayout ensures the statistics loaded into a different
+// bucket layout keep the invariants of each bucket: the confirmation ranges are
+// cumulative and the last one holds every mined tx.
+func TestLoadFeeEstimatorRelayout(t *testing.T) {
+	cfg := validConfig()
+	estimator, err := NewFeeEstimator(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// both fee rates fall into the same bucket of the saved layout, but on
+	// different sides of the 0.000205 DCR/KB bound of the new one, and the
+	// txs paying each rate are mined after a different number of blocks, so
+	// the average fee rate of the fastest ranges differs from the bucket's
+	estimator.SetBestHeight(0)
+	var hashes []chainhash.Hash
+	for height := int64(1); height <= 50; height++ {
+		var mined []*chainhash.Hash
+		if height > 1 {
+			mined = append(mined, &hashes[(height-2)*3])
+		}
+		if height > 3 {
+			mined = append(mined, &hashes[(height-4)*3+1],
+				&hashes[(height-4)*3+2])
+		}
+		estimator.ProcessMinedTransactions(height, mined)
+		for i := byte(0); i < 3; i++ {
+			hash := chainhash.Hash{byte(height), i}
+			hashes = append(hashes, hash)
+			fee := int64(21000)
+			if i == 0 {
+				fee = 20000
+			}
+			estimator.AddMemPoolTransaction(&hash, fee, 1000)
+		}
+	}
+	if estimator.lowerBucket(20000) != estimator.lowerBucket(21000) {
+		t.Fatalf("expected both fee rates in the same saved bucket")
+	}
+
+	var buf bytes.Buffer
+	if err := estimator.Save(&buf); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	coarse := FeeEstimatorConfig{
+		MaxConfirms: cfg.MaxConfirms,
+		BucketLayout: BucketLayout{
+			Bounds: []dcrutil.Amount{1e4, 20500, 4e4},
+		},
+	}
+	loaded, err := LoadFeeEstimator(&coarse, &buf)
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+
+	for b, bucket := range loaded.buckets {
+		last := bucket.confirmed[len(bucket.confirmed)-1]
+		if math.Abs(last.txCount-bucket.confirmCount) > 1e-9 ||
+			math.Abs(last.feeSum-bucket.feeSum) > 1e-3 {
+			t.Errorf("bucket %d: last range (%f txs, fee sum %f) doesn't "+
+				"match the bucket totals (%f txs, fee sum %f)", b,
+				last.txCount, last.feeSum, bucket.confirmCount,
+				bucket.feeSum)
+		}
+		for c := 1; c < len(bucket.confirmed); c++ {
+			if bucket.confirmed[c].txCount < bucket.confirmed[c-1].txCount-1e-9 {
+				t.Errorf("bucket %d: range %d has less txs (%f) than range "+
+					"%d (%f)", b, c, bucket.confirmed[c].txCount, c-1,
+					bucket.confirmed[c-1].txCount)
+			}
+		}
+	}
+}
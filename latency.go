@@ -0,0 +1,216 @@
+// Latency module. This tracks how long the simulated txs of each fee rate band
+// took to be mined, so that the real confirmation latency of each band can be
+// compared to the confirmation ratios tracked by the estimator buckets.
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	// latencyMinTxs is the minimum number of txs in a fee rate band for it to
+	// be included in the latency reports
+	latencyMinTxs = 100
+
+	// latencyHeatMapLevels are the characters used to draw the latency heat
+	// map, from the lowest to the highest fraction of mined txs
+	latencyHeatMapLevels = " .:-=+*#%@"
+)
+
+// latencyCurves tracks, for each fee rate band, the number of generated txs and
+// the number of those mined after each number of blocks. The bands are the fee
+// rate buckets of the estimator.
+type latencyCurves struct {
+	bounds      []feeRate
+	maxConfirms int
+
+	// maxGenHeight is the height of the last block whose txs are tracked. Txs
+	// generated afterwards may not have had the chance to be mined within
+	// maxConfirms blocks by the end of the simulation.
+	maxGenHeight uint32
+
+	generated  []int
+	minedAfter [][]int
+}
+
+// newLatencyCurves returns empty latency curves for the fee rate buckets of the
+// given estimator, tracking txs generated up to the given height.
+func newLatencyCurves(estimator *FeeEstimator, maxGenHeight uint32) *latencyCurves {
+	lc := &latencyCurves{
+		bounds:       estimator.bucketFeeBounds,
+		maxConfirms:  int(estimator.maxConfirms),
+		maxGenHeight: maxGenHeight,
+		generated:    make([]int, len(estimator.bucketFeeBounds)),
+		minedAfter:   make([][]int, len(estimator.bucketFeeBounds)),
+	}
+	for b := range lc.minedAfter {
+		lc.minedAfter[b] = make([]int, lc.maxConfirms)
+	}
+	return lc
+}
+
+// band returns the fee rate band of a tx (the same bucket the estimator uses
+// for the fee rate).
+func (lc *latencyCurves) band(tx *simTx) int {
+	rate := feeRate(tx.feeRate)
+	return sort.Search(len(lc.bounds), func(i int) bool {
+		return lc.bounds[i] >= rate
+	})
+}
+
+// tracked returns whether the tx is tracked by the latency curves: regular txs
+// created by honest users early enough in the simulation.
+func (lc *latencyCurves) tracked(tx *simTx) bool {
+	return tx.attacker == nil && tx.genHeight <= lc.maxGenHeight
+}
+
+// addGenerated tracks newly generated txs.
+func (lc *latencyCurves) addGenerated(txs []*simTx) {
+	for _, tx := range txs {
+		if lc.tracked(tx) {
+			lc.generated[lc.band(tx)]++
+		}
+	}
+}
+
+// addMined tracks newly mined txs.
+func (lc *latencyCurves) addMined(txs []*simTx) {
+	for _, tx := range txs {
+		if !lc.tracked(tx) {
+			continue
+		}
+		delay := int(tx.minedHeight - tx.genHeight)
+		if delay >= 1 && delay <= lc.maxConfirms {
+			lc.minedAfter[lc.band(tx)][delay-1]++
+		}
+	}
+}
+
+// curve returns the fraction of the txs of a band mined within 1, 2, ...,
+// maxConfirms blocks.
+func (lc *latencyCurves) curve(b int) []float64 {
+	res := make([]float64, lc.maxConfirms)
+	mined := 0
+	for c := range res {
+		mined += lc.minedAfter[b][c]
+		if lc.generated[b] > 0 {
+			res[c] = float64(mined) / float64(lc.generated[b])
+		}
+	}
+	return res
+}
+
+// estimatorCurve returns the ratio of txs confirmed within 1, 2, ...,
+// maxConfirms-1 blocks for the given bucket of the estimator, computed the
+// same way as when estimating fees (unconfirmed txs count as not confirmed).
+// The ratio is only known at the upper bounds of the confirmation ranges of
+// the estimator, so it is NaN for other numbers of blocks. The last
+// confirmation range has no upper bound, so its ratio is NaN as well.
+func estimatorCurve(estimator *FeeEstimator, b int) []float64 {
+	bucket := &estimator.buckets[b]
+	memPool := &estimator.memPool[b]
+	res := make([]float64, estimator.maxConfirms)
+	for i := range res {
+		res[i] = math.NaN()
+	}
+	scale := estimator.decayScale
+	for c, blocks := range estimator.confirmBounds {
+		total := bucket.confirmCount*scale + memPool.confirmed[c].txCount
+		if total > 0 {
+			res[blocks-1] = bucket.confirmed[c].txCount * scale / total
+		}
+	}
+	return res
+}
+
+// latencyColumns returns the number of blocks shown in the columns of the
+// latency table.
+func (lc *latencyCurves) latencyColumns() []int {
+	var cols []int
+	for _, c := range []int{1, 2, 3, 4, 6, 8, 12, 16, 24, 32, 48, 64, 96,
+		144, 288} {
+		if c < lc.maxConfirms {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// reportLatency prints the latency table of the bands with enough txs, with
+// the curves of the simulated txs next to the ratios of the estimator buckets,
+// followed by a heat map of the curves.
+func (run *simRun) reportLatency(w io.Writer) {
+	lc := run.latency
+	cols := lc.latencyColumns()
+
+	fmt.Fprintf(w, "%% of txs mined within N blocks by fee rate band (sim: "+
+		"simulated txs, est: estimator bucket ratios)\n")
+	l := fmt.Sprintf("%10s %9s    ", "band", "txs")
+	for _, c := range cols {
+		l += fmt.Sprintf("%7d", c)
+	}
+	fmt.Fprintln(w, l)
+
+	for b := range lc.bounds {
+		if lc.generated[b] < latencyMinTxs {
+			continue
+		}
+		curve := lc.curve(b)
+		est := estimatorCurve(run.estimator, b)
+		l1 := fmt.Sprintf("%10.8f %9d sim", float64(lc.bounds[b])/1e8,
+			lc.generated[b])
+		l2 := fmt.Sprintf("%10s %9s est", "", "")
+		for _, c := range cols {
+			l1 += fmt.Sprintf("%7.2f", curve[c-1]*100)
+			if math.IsNaN(est[c-1]) {
+				l2 += fmt.Sprintf("%7s", "-")
+			} else {
+				l2 += fmt.Sprintf("%7.2f", est[c-1]*100)
+			}
+		}
+		fmt.Fprintf(w, "%s\n%s\n", l1, l2)
+	}
+
+	levels := latencyHeatMapLevels
+	fmt.Fprintf(w, "\nLatency heat map (%% of simulated txs mined within "+
+		"1-%d blocks: '%c' = 0%%, '%c' = 100%%)\n", lc.maxConfirms,
+		levels[0], levels[len(levels)-1])
+	for b := range lc.bounds {
+		if lc.generated[b] < latencyMinTxs {
+			continue
+		}
+		l := fmt.Sprintf("%10.8f |", float64(lc.bounds[b])/1e8)
+		for _, f := range lc.curve(b) {
+			l += string(levels[int(f*float64(len(levels)-1))])
+		}
+		fmt.Fprintln(w, l+"|")
+	}
+	fmt.Fprintln(w)
+}
+
+// writeLatencyCSV writes the full latency curves of the bands with enough txs
+// as CSV, with one line per band and number of blocks, for charting.
+func (run *simRun) writeLatencyCSV(w io.Writer) {
+	lc := run.latency
+	fmt.Fprintln(w, "band_upper_bound,txs,blocks,sim_mined_fraction,"+
+		"est_confirmed_ratio")
+	for b := range lc.bounds {
+		if lc.generated[b] < latencyMinTxs {
+			continue
+		}
+		curve := lc.curve(b)
+		est := estimatorCurve(run.estimator, b)
+		for c := range curve {
+			estRatio := ""
+			if !math.IsNaN(est[c]) {
+				estRatio = fmt.Sprintf("%.6f", est[c])
+			}
+			fmt.Fprintf(w, "%.8f,%d,%d,%.6f,%s\n",
+				float64(lc.bounds[b])/1e8, lc.generated[b], c+1, curve[c],
+				estRatio)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Bucket layout module. This builds the upper bounds of the fee rate buckets of
+// the estimator from its config, either as a single geometric range (the
+// original layout) or as a combination of explicit bounds, geometric ranges and
+// pinned fee rates, along with the upper bounds of its confirmation ranges.
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/decred/dcrd/dcrutil"
+)
+
+// legacyPinnedFee is the fee rate (in atoms/KB) that the wallet usually uses
+// (0.001 DCR/KB). A bucket bound is added at this exact fee rate to the layout
+// defined by MinBucketFee, MaxBucketFee and FeeRateStep in order to improve
+// estimation at this level. Once the network in general and the default wallet
+// in particular start using the lower minimum relay rate, this can probably be
+// dropped.
+const legacyPinnedFee = 1e5
+
+// BucketRange is a range of fee rate buckets whose upper bounds grow
+// geometrically: Min, Min*Step, Min*Step^2, ... while lower than Max.
+type BucketRange struct {
+	Min  dcrutil.Amount
+	Max  dcrutil.Amount
+	Step float64
+}
+
+// BucketLayout defines the upper bounds (in atoms/KB) of the fee rate buckets
+// of an estimator as the union of an explicit list of bounds, the bounds of
+// geometric ranges and pinned fee rates (for example the relay fee and common
+// wallet defaults). The lowest bound is the minimum tracked fee rate and a
+// last bucket with an upper bound of +Inf is always added.
+type BucketLayout struct {
+	Bounds []dcrutil.Amount
+	Ranges []BucketRange
+	Pins   []dcrutil.Amount
+}
+
+// isEmpty returns whether the layout doesn't define any bucket.
+func (l *BucketLayout) isEmpty() bool {
+	return len(l.Bounds) == 0 && len(l.Ranges) == 0 && len(l.Pins) == 0
+}
+
+// validate returns an error describing the first invalid parameter found in the
+// layout.
+func (l *BucketLayout) validate() error {
+	for i, b := range l.Bounds {
+		if b <= 0 {
+			return fmt.Errorf("BucketLayout.Bounds[%d] (%v) must be positive",
+				i, b)
+		}
+		if i > 0 && b <= l.Bounds[i-1] {
+			return fmt.Errorf("BucketLayout.Bounds must be in increasing "+
+				"order (%v follows %v)", b, l.Bounds[i-1])
+		}
+	}
+	for i, r := range l.Ranges {
+		if r.Min <= 0 {
+			return fmt.Errorf("BucketLayout.Ranges[%d].Min (%v) must be "+
+				"positive", i, r.Min)
+		}
+		if r.Max <= r.Min {
+			return fmt.Errorf("BucketLayout.Ranges[%d].Max (%v) must be "+
+				"higher than Min (%v)", i, r.Max, r.Min)
+		}
+		if !(r.Step > 1) || math.IsInf(r.Step, 1) {
+			return fmt.Errorf("BucketLayout.Ranges[%d].Step (%f) must be a "+
+				"finite number higher than 1", i, r.Step)
+		}
+	}
+	for i, p := range l.Pins {
+		if p <= 0 {
+			return fmt.Errorf("BucketLayout.Pins[%d] (%v) must be positive",
+				i, p)
+		}
+	}
+	return nil
+}
+
+// geometricBounds returns the bounds of a geometric range of buckets.
+func geometricBounds(min, max dcrutil.Amount, step float64) []feeRate {
+	var res []feeRate
+	for f := float64(min); f < float64(max); f *= step {
+		res = append(res, feeRate(f))
+	}
+	return res
+}
+
+// bucketLayout returns the upper bounds of the fee rate buckets defined by the
+// config, including the last +Inf one, along with the pinned fee rates.
+func (cfg *FeeEstimatorConfig) bucketLayout() ([]feeRate, []feeRate) {
+	var bounds, pins []feeRate
+	if cfg.BucketLayout.isEmpty() {
+		bounds = geometricBounds(cfg.MinBucketFee, cfg.MaxBucketFee,
+			cfg.FeeRateStep)
+		if bounds[len(bounds)-1] > legacyPinnedFee {
+			pins = append(pins, legacyPinnedFee)
+		}
+	} else {
+		l := &cfg.BucketLayout
+		for _, b := range l.Bounds {
+			bounds = append(bounds, feeRate(b))
+		}
+		for _, r := range l.Ranges {
+			bounds = append(bounds, geometricBounds(r.Min, r.Max, r.Step)...)
+		}
+		for _, p := range l.Pins {
+			pins = append(pins, feeRate(p))
+		}
+	}
+	bounds = append(bounds, pins...)
+
+	// sort and remove duplicates (eg, pins that are also range bounds)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	res := bounds[:0]
+	for i, b := range bounds {
+		if i == 0 || b != bounds[i-1] {
+			res = append(res, b)
+		}
+	}
+
+	// The last bucket catches everything else, so it uses an upper bound of
+	// +inf which any rate must be lower than
+	res = append(res, feeRate(math.Inf(1)))
+
+	return res, pins
+}
+
+// layoutString returns a short description of the bucket layout of the
+// estimator.
+func (stats *FeeEstimator) layoutString() string {
+	bounds := stats.bucketFeeBounds
+	s := fmt.Sprintf("%d buckets with bounds from %.8f to %.8f DCR/KB",
+		len(bounds), bounds[0]/1e8, bounds[len(bounds)-2]/1e8)
+	if len(stats.pinnedFees) > 0 {
+		pins := make([]string, len(stats.pinnedFees))
+		for i, p := range stats.pinnedFees {
+			pins[i] = fmt.Sprintf("%.8f", p/1e8)
+		}
+		s += fmt.Sprintf(", pinned at %s", strings.Join(pins, ", "))
+	}
+	return s
+}
+
+// confirmBounds returns the upper bounds (in blocks) of the confirmation ranges
+// defined by the config, except for the last (+Inf) one.
+func (cfg *FeeEstimatorConfig) confirmBounds() []int32 {
+	var res []int32
+	if len(cfg.ConfirmRanges) == 0 {
+		for c := uint32(1); c < cfg.MaxConfirms; c++ {
+			res = append(res, int32(c))
+		}
+		return res
+	}
+	for _, c := range cfg.ConfirmRanges {
+		res = append(res, int32(c))
+	}
+	return res
+}
+
+// confirmRangesString returns a short description of the confirmation ranges
+// of the estimator.
+func (stats *FeeEstimator) confirmRangesString() string {
+	bounds := stats.confirmBounds
+	if bounds[len(bounds)-1] == int32(len(bounds)) {
+		return fmt.Sprintf("%d ranges of 1 block, then +Inf", len(bounds))
+	}
+	s := make([]string, len(bounds))
+	for i, c := range bounds {
+		s[i] = fmt.Sprintf("%d", c)
+	}
+	return "up to " + strings.Join(s, ", ") + " blocks, then +Inf"
+}
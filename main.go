@@ -3,14 +3,21 @@ package main
 import (
 	"container/heap"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/decred/dcrd/dcrutil"
 	"github.com/decred/slog"
 )
 
 type testCase struct {
+	// description is a short description of the scenario simulated by the
+	// test case, used in the generated reports
+	description string
+
 	simCfg          simulatorConfig
 	estCfg          FeeEstimatorConfig
 	testTargetConfs []int32
@@ -25,6 +32,10 @@ var (
 		// all transactions are published with a minimum fee rate of 0.0001
 		// dcr/KB
 		testCase{
+			description: "Base test for the other cases. Blocks still aren't that filled " +
+				"and generated transactions always pay a minimum fee rate of " +
+				"0.0001 DCR/KB. Uses a maximum of 32 confirmation windows and " +
+				"a 1.1 fee bucket multiplier.",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      250.0,
 				txSizeCoef:     1000.0,
@@ -42,6 +53,9 @@ var (
 
 		// TestCase 02 test scenario where mempool is filled 99% of the time
 		testCase{
+			description: "Based on test 01, with a higher rate of generated transactions " +
+				"per block (> 99% of the blocks leave transactions in mempool " +
+				"after mining).",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      320.0,
 				txSizeCoef:     1000.0,
@@ -59,6 +73,8 @@ var (
 
 		// TestCase 03 test scenario where there are no minimum relay fees
 		testCase{
+			description: "Based on test 01, but transactions are not generated with " +
+				"minimum fees (so they have a higher distribution of fee rates).",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      250.0,
 				txSizeCoef:     1000.0,
@@ -78,6 +94,7 @@ var (
 		// transactions are generated at a higher rate and using a higher
 		// confirmation window
 		testCase{
+			description: "Based on test 02, without minimum fees.",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      320.0,
 				txSizeCoef:     1000.0,
@@ -95,6 +112,8 @@ var (
 
 		// TestCase 05: Same as test 01, with lower contention rate
 		testCase{
+			description: "Based on test 01, with lower contention (~5% of blocks mined " +
+				"leave txs in mempool).",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      105.0,
 				txSizeCoef:     1000.0,
@@ -114,6 +133,8 @@ var (
 		// fee spread distribution. Max fee bucket and FeeRateStep are adjusted
 		// to improve estimates.
 		testCase{
+			description: "Based on test 05, with a smaller simulated fee range " +
+				"distribution.",
 			simCfg: simulatorConfig{
 				nbTxsCoef:               105.0,
 				txSizeCoef:              1000.0,
@@ -132,6 +153,8 @@ var (
 
 		// TestCase 07: Same as test 01 but with slighly higher contention rate
 		testCase{
+			description: "Based on test 01, with lower contention (~10% of blocks mined " +
+				"leave txs in mempool).",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      125.0,
 				txSizeCoef:     1000.0,
@@ -148,6 +171,8 @@ var (
 		},
 
 		testCase{
+			description: "Very low contention, with all transactions paying close to " +
+				"the minimum fee rate of 0.001 DCR/KB.",
 			simCfg: simulatorConfig{
 				nbTxsCoef:      20.0,
 				txSizeCoef:     500.0,
@@ -162,36 +187,637 @@ var (
 			},
 			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
 		},
+
+		// TestCase 09: Same as test 01, but the miner keeps filling the block
+		// with smaller transactions after finding one that doesn't fit and
+		// reserves an area of the block for older (high priority) transactions
+		testCase{
+			description: "Based on test 01, but the miner keeps filling the block with " +
+				"smaller txs after finding one that doesn't fit and reserves " +
+				"20KB of the block for high priority (older) txs.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				minerPolicy: minerPolicy{
+					fillBlock:    true,
+					prioritySize: 20000,
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 10: Same as test 01, but the miner uses a soft block size
+		// limit, requires a minimum fee rate higher than the relay fee and
+		// reserves space for stake transactions
+		testCase{
+			description: "Based on test 01, but the miner uses a soft block size limit " +
+				"of 300KB (reserving 10KB of it for stake txs), only includes " +
+				"txs paying at least 0.00015 DCR/KB and keeps filling the " +
+				"block with smaller txs after finding one that doesn't fit.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				minerPolicy: minerPolicy{
+					fillBlock:     true,
+					minFeeRate:    1.5e4,
+					softBlockSize: 300000,
+					stakeReserve:  10000,
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 11: Same as test 01, but the hash power is split among
+		// pools using different mining policies, one of which often mines
+		// empty blocks
+		testCase{
+			description: "Based on test 01, but hash power is split among 5 miners: a " +
+				"greedy miner (40%), a miner that fills blocks with smaller " +
+				"txs (25%), a miner using a 250KB soft block size (15%), a " +
+				"miner requiring a minimum fee rate of 0.0002 DCR/KB (10%) and " +
+				"a miner that mines empty blocks half of the time (10%).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				miners: []simMiner{
+					{name: "greedy", hashShare: 0.4},
+					{name: "filler", hashShare: 0.25,
+						policy: minerPolicy{fillBlock: true}},
+					{name: "softlimit", hashShare: 0.15,
+						policy: minerPolicy{fillBlock: true,
+							softBlockSize: 250000}},
+					{name: "highfee", hashShare: 0.1,
+						policy: minerPolicy{minFeeRate: 2e4}},
+					{name: "empty", hashShare: 0.1,
+						policy: minerPolicy{emptyBlockRate: 0.5}},
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 12: Same as test 02, but half of the transactions are
+		// generated by wallets that pay the fee rate suggested by the
+		// estimator (for a random target of up to 16 blocks)
+		testCase{
+			description: "Based on test 02, but half of the generated txs pay the fee " +
+				"rate suggested by the estimator for a random target between " +
+				"1 and 16 blocks.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:            320.0,
+				txSizeCoef:           1000.0,
+				minimumFeeRate:       1e4,
+				feeRateCoef:          2.5e4,
+				estimatorFeeFraction: 0.5,
+				estimatorMaxTarget:   16,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 4, 6, 8, 12, 18, 24, 32},
+		},
+
+		// TestCase 13: Same as test 02, but with a limited mempool: 30% of
+		// txs expire after 24 blocks, txs are removed after staying a day in
+		// the mempool and the lowest fee rate txs are evicted once the mempool
+		// goes over 2MB
+		testCase{
+			description: "Based on test 02, but 30% of the txs expire 24 blocks after " +
+				"being published, txs are removed from the mempool after 288 " +
+				"blocks and the txs with the lowest fee rates are evicted once " +
+				"the mempool goes over 2MB.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      320.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				expiryFraction: 0.3,
+				expiryDelta:    24,
+				maxMemPoolSize: 2e6,
+				maxTxAge:       288,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 4, 6, 8, 12, 18, 24, 32},
+		},
+
+		// TestCase 14: Same as test 01, with ticket purchases demanding more
+		// than the available 20 tickets per block (half of them right after
+		// the ticket price changes) and 1% of missed votes
+		testCase{
+			description: "Based on test 01, but ticket purchases demand ~3200 tickets " +
+				"per ticket price window (more than the 2880 tickets that can " +
+				"be mined), half of them right after the price changes, and " +
+				"1% of votes are missed and revoked.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				stake: stakeConfig{
+					ticketsPerWindow:  3200,
+					surgeFraction:     0.5,
+					ticketFeeRate:     1e4,
+					ticketFeeRateCoef: 2e4,
+					missedVoteRate:    0.01,
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 15: Same as test 01, but 20% of the txs spend outputs of
+		// unconfirmed txs (in chains of up to 5 txs) and 10% of those pay 10x
+		// the usual fee rate to bump their ancestors (child pays for parent)
+		testCase{
+			description: "Based on test 01, but 20% of the txs spend outputs of " +
+				"unconfirmed txs, in chains of up to 5 txs, and 10% of the " +
+				"chained txs pay 10x the usual fee rate to bump the fee rate " +
+				"of their ancestors (child pays for parent).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:       250.0,
+				txSizeCoef:      1000.0,
+				minimumFeeRate:  1e4,
+				feeRateCoef:     2.5e4,
+				chainTxFraction: 0.2,
+				maxChainDepth:   5,
+				cpfpFraction:    0.1,
+				cpfpFeeRateMult: 10,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 16: Same as test 01, but a miner with 20% of the hash power
+		// broadcasts txs paying a very high fee rate to itself right before
+		// mining each of its blocks (fee inflation attack)
+		testCase{
+			description: "Based on test 01, but a miner with 20% of the hash power " +
+				"broadcasts 50 txs paying 0.02 DCR/KB to itself right before " +
+				"mining each of its blocks (fee inflation attack).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				miners: []simMiner{
+					{name: "honest", hashShare: 0.8},
+					{name: "inflator", hashShare: 0.2},
+				},
+				attackers: []attackerConfig{
+					{kind: attackFeeInflation, miner: "inflator",
+						txsPerBlock: 50, txSize: 300, feeRate: 2e6},
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 17: Same as test 01, but an attacker floods the network with
+		// small txs paying the minimum fee rate (spam attack)
+		testCase{
+			description: "Based on test 01, but a spammer broadcasts 200 small txs " +
+				"paying the minimum fee rate after every block.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				attackers: []attackerConfig{
+					{kind: attackSpam, txsPerBlock: 200},
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 18: Same as test 01, but sybil nodes hide half of the txs
+		// paying up to 0.0002 DCR/KB from the node running the estimator
+		testCase{
+			description: "Based on test 01, but sybil nodes hide half of the txs paying " +
+				"up to 0.0002 DCR/KB from the node running the estimator.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+				attackers: []attackerConfig{
+					{kind: attackHideTxs, hiddenFraction: 0.5,
+						hideMaxFeeRate: 2e4},
+				},
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 19: Same as test 01, but the estimator statistics decay
+		// faster (half-life of 144 blocks instead of ~346)
+		testCase{
+			description: "Based on test 01, but the estimator statistics decay faster " +
+				"(a half-life of 144 blocks, roughly half a day, instead of " +
+				"the default ~346 blocks).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:   32,
+				MinBucketFee:  1e4,
+				MaxBucketFee:  4e5,
+				FeeRateStep:   1.1,
+				DecayHalfLife: 144,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 20: Same as test 01, but estimating fees at a lower success
+		// pct
+		testCase{
+			description: "Based on test 01, but the estimator only requires 85% of the " +
+				"txs to be confirmed within the target (instead of 95%).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+				SuccessPct:   0.85,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 21: Same as test 01, but requiring more txs in a range of
+		// buckets before considering it
+		testCase{
+			description: "Based on test 01, but the estimator requires a range of fee " +
+				"rate buckets to have at least 10000 (decayed) txs before " +
+				"considering its success ratio, so ranges usually span " +
+				"multiple buckets.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+				MinTxCount:   10000,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 22: Same as test 01, but the estimator computes exact fee
+		// rates
+		testCase{
+			description: "Based on test 01, but the estimator computes exact fee rates " +
+				"(fee * 1000 / size, rounded to the nearest atom/KB) instead of " +
+				"downsampling them to whole atoms/byte.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+				FeeRateMode:  FeeRateExactNearest,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 23: Same as test 03, but the estimator computes exact fee
+		// rates
+		testCase{
+			description: "Based on test 03, but the estimator computes exact fee rates " +
+				"(rounded to the nearest atom/KB), so the txs paying less than " +
+				"1 atom/byte are tracked instead of being downsampled to zero.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 0,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 100,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+				FeeRateMode:  FeeRateExactNearest,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 24: test scenario where most txs pay less than 1 atom/byte
+		// (downsampled fee rates)
+		testCase{
+			description: "Based on test 01, but with a minimum fee rate of 0.000001 DCR/KB " +
+				"and fee rates 10 times lower, so most txs pay less than 1 " +
+				"atom/byte. The estimator downsamples fee rates (the default).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 100,
+				feeRateCoef:    2.5e3,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 100,
+				MaxBucketFee: 4e4,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 25: Same as test 24, but the estimator computes exact fee
+		// rates
+		testCase{
+			description: "Based on test 24, but the estimator computes exact fee rates " +
+				"(rounded to the nearest atom/KB).",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 100,
+				feeRateCoef:    2.5e3,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms:  32,
+				MinBucketFee: 100,
+				MaxBucketFee: 4e4,
+				FeeRateStep:  1.1,
+				FeeRateMode:  FeeRateExactNearest,
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 26: Same as test 01, but using an explicit bucket layout
+		// with finer buckets where most txs are
+		testCase{
+			description: "Based on test 01, but with an explicit bucket layout: " +
+				"1.05 fee bucket multiplier up to 0.0005 DCR/KB, 1.25 above " +
+				"that and buckets pinned at the relay fee and the 0.0002 and " +
+				"0.001 DCR/KB wallet defaults.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      250.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				MaxConfirms: 32,
+				BucketLayout: BucketLayout{
+					Ranges: []BucketRange{
+						{Min: 1e4, Max: 5e4, Step: 1.05},
+						{Min: 5e4, Max: 4e5, Step: 1.25},
+					},
+					Pins: []dcrutil.Amount{1e4, 2e4, 1e5},
+				},
+			},
+			testTargetConfs: []int32{1, 2, 3, 4, 5, 6, 8, 16, 32},
+		},
+
+		// TestCase 27: Same as test 02, but tracking confirmations of up to a
+		// day using grouped confirmation ranges
+		testCase{
+			description: "Based on test 02, but with grouped confirmation ranges " +
+				"of up to 288 blocks (roughly a day) instead of a maximum of " +
+				"32 confirmation windows.",
+			simCfg: simulatorConfig{
+				nbTxsCoef:      320.0,
+				txSizeCoef:     1000.0,
+				minimumFeeRate: 1e4,
+				feeRateCoef:    2.5e4,
+			},
+			estCfg: FeeEstimatorConfig{
+				ConfirmRanges: []uint32{1, 2, 3, 4, 6, 8, 12, 16, 24, 48, 96,
+					144, 288},
+				MinBucketFee: 1e4,
+				MaxBucketFee: 4e5,
+				FeeRateStep:  1.1,
+			},
+			testTargetConfs: []int32{1, 2, 4, 8, 12, 24, 48, 144, 288},
+		},
 	}
 )
 
+const (
+	// defaultSeed is the seed of the random number generator used by single
+	// runs of the simulator. Monte Carlo runs use consecutive seeds starting
+	// at this one.
+	defaultSeed = 0x1701d
+
+	// lenSimulation is how long to run the simulation of blocks before trying
+	// to estimate the fees
+	lenSimulation = uint32(288 * 30 * 3)
+)
+
+// probeFeeRates are the fee rates (in atoms/KB) whose confirmation probability
+// is reported at the end of the simulation.
+var probeFeeRates = []dcrutil.Amount{1e4, 1.5e4, 2e4, 3e4, 5e4, 1e5}
+
+// simRun holds the state of the simulator and estimators after running the
+// simulation of a test case.
+type simRun struct {
+	tc               *testCase
+	seed             int64
+	sim              *simulator
+	estimator        *FeeEstimator
+	refEstimator     *FeeEstimator
+	estimatesHistory []string
+	duration         time.Duration
+
+	// height is the height of the last simulated block
+	height uint32
+
+	// oracle computes the fee rates that actually worked during the
+	// simulation and oracleErrors are the errors of the estimates relative to
+	// it, for each target confirmation of the test case
+	oracle       *feeOracle
+	oracleErrors []oracleErrors
+
+	// latency tracks the confirmation latency of the simulated txs of each
+	// fee rate band
+	latency *latencyCurves
+
+	// memPoolChecks are the results of the checks of the mempool stats of the
+	// estimators (only when running in check mode)
+	memPoolChecks *memPoolChecks
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Please specify the test number")
 		os.Exit(1)
 	}
 
-	testNb, err := strconv.Atoi(os.Args[1])
+	switch os.Args[1] {
+	case "mc":
+		mcMain(os.Args[2:])
+		return
+	case "runall":
+		runAllMain(os.Args[2:])
+		return
+	case "report":
+		reportMain(os.Args[2:])
+		return
+	case "check":
+		checkMain(os.Args[2:])
+		return
+	}
+
+	actualTest, err := parseTestCase(os.Args[1])
 	if err != nil {
-		fmt.Println("Please specify a number as test case")
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	if testNb-1 > len(testCases) {
-		fmt.Printf("Please specify a test in the range of 1-%d\n", len(testCases))
-		os.Exit(1)
+
+	run := runSimulation(actualTest, defaultSeed, false, func(pct uint32) {
+		fmt.Fprintf(os.Stderr, "%d%% ", pct)
+	})
+	fmt.Fprintf(os.Stderr, "\n\n")
+	fmt.Fprintf(os.Stderr, "Total time: %s\n", run.duration.String())
+
+	run.report(os.Stdout)
+}
+
+// setupString returns the parameters of the test case, as printed in the setup
+// section of the results.
+func (tc *testCase) setupString() string {
+	return fmt.Sprintf("{simCfg:%+v estCfg:%+v testTargetConfs:%v}",
+		tc.simCfg, tc.estCfg, tc.testTargetConfs)
+}
+
+// parseTestCase returns the test case with the given (1-based) number.
+func parseTestCase(arg string) (*testCase, error) {
+	testNb, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("Please specify a number as test case")
+	}
+	if testNb < 1 || testNb > len(testCases) {
+		return nil, fmt.Errorf("Please specify a test in the range of 1-%d",
+			len(testCases))
 	}
-	actualTest := testCases[testNb-1]
+	tc := &testCases[testNb-1]
+	if err := tc.estCfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid estimator config in test %d: %v",
+			testNb, err)
+	}
+	return tc, nil
+}
 
-	// How long to run the simulation of blocks before trying to estimate the
-	// fees
-	lenSimulation := uint32(288 * 30 * 3)
+// runSimulation simulates the network of the given test case, using the given
+// seed for the random number generator, and feeds the estimator with it. If
+// check is true, the mempool stats of the estimators are checked after every
+// block. If progress is not nil, it is called with the percentage of the
+// simulation completed.
+func runSimulation(actualTest *testCase, seed int64, check bool,
+	progress func(pct uint32)) *simRun {
 
-	sim := newSimulator(&actualTest.simCfg)
-	var newTxs, minedTxs []*simTx
+	sim := newSimulator(&actualTest.simCfg, seed)
+	var newTxs, minedTxs, removedTxs, evictedTxs []*simTx
+	var newStxs, minedStxs []*simTx
+	var inflationTxs, spamTxs []*simTx
 	memPool := make(txPool, 0)
 	heap.Init(&memPool)
 
-	estimator := NewFeeEstimator(&actualTest.estCfg)
+	// the simulated chain starts at the genesis block, so the estimator is
+	// able to track txs broadcast before the first simulated block is mined
+	estimator, err := NewFeeEstimator(&actualTest.estCfg)
+	if err != nil {
+		// test cases are validated before being run
+		panic(err)
+	}
+	estimator.SetBestHeight(0)
+	sim.estimateFee = func(targetConfs int32) (feeRate, error) {
+		return estimator.estimateMedianFee(targetConfs, estimator.successPct)
+	}
+	var estimatesHistory []string
+	oracle := newFeeOracle(actualTest.testTargetConfs)
+	oracleErrs := make([]oracleErrors, len(actualTest.testTargetConfs))
+	latency := newLatencyCurves(estimator,
+		lenSimulation-1-uint32(estimator.maxConfirms))
+
+	// When simulating attacks, a reference estimator is fed only with the
+	// honest traffic (including the txs hidden from the attacked node) to
+	// measure how far the attacks push the estimates. It uses the same (thus
+	// valid) config as the attacked one.
+	var refEstimator *FeeEstimator
+	if len(actualTest.simCfg.attackers) > 0 {
+		refEstimator, _ = NewFeeEstimator(&actualTest.estCfg)
+		refEstimator.SetBestHeight(0)
+	}
+
+	var checks *memPoolChecks
+	if check {
+		checks = &memPoolChecks{}
+	}
 
 	start := time.Now()
 
@@ -200,66 +826,247 @@ func main() {
 	// - some new transactions appearing in the network and being added to the
 	// outstanding mempool
 	for h := uint32(1); h < lenSimulation; h++ {
-		minedTxs = sim.mineTransactions(h, &memPool)
+		removedTxs = sim.pruneMemPool(h, &memPool)
+		minerIdx := sim.pickMiner()
+		inflationTxs = sim.genFeeInflationTxs(h, minerIdx, &memPool)
+		minedTxs, minedStxs = sim.mineTransactions(h, minerIdx, &memPool)
+		latency.addMined(minedTxs)
 		newTxs = sim.genTransactions(h, &memPool)
-		sim.trackHistograms(minedTxs, newTxs, h)
+		oracle.addTxs(newTxs)
+		latency.addGenerated(newTxs)
+		newStxs = sim.genStakeTransactions(h)
+		spamTxs = sim.genSpamTxs(h, &memPool)
+		evictedTxs = sim.limitMemPool(h, &memPool)
+		sim.trackHistograms(minedTxs, minedStxs, newTxs, h)
 
 		// Update the estimator (this is thing that would actually run in the
 		// mempool of a full node once a new block has been fonud)
-		estimator.ProcessMinedTransactions(int64(h), simTxHashes(minedTxs))
+		block := newSimBlock(h, minedTxs, minedStxs)
+		published := make([]*simTx, 0, len(newTxs)+len(newStxs)+len(spamTxs))
+		published = append(published, newTxs...)
+		published = append(published, newStxs...)
+		published = append(published, spamTxs...)
+		updateEstimator(estimator, block, inflationTxs, removedTxs, published,
+			evictedTxs, seenByNode)
+		if refEstimator != nil {
+			updateEstimator(refEstimator, block, inflationTxs, removedTxs,
+				published, evictedTxs, isHonestTx)
+		}
+		if checks != nil {
+			checks.check(h, "main", estimator)
+			if refEstimator != nil {
+				checks.check(h, "reference", refEstimator)
+			}
+		}
 
-		// This would happen as new transactions are entering the memPool
-		for _, tx := range newTxs {
-			estimator.AddMemPoolTransaction(&tx.txHash, int64(tx.fee), int64(tx.size))
+		if h%(lenSimulation/20) == 0 {
+			l := fmt.Sprintf("%8d", h)
+			for _, t := range actualTest.testTargetConfs {
+				l += formatEstimate(estimator.estimateMedianFee(t, estimator.successPct))
+			}
+			estimatesHistory = append(estimatesHistory, l)
+			oracle.sample(estimator, h, actualTest.testTargetConfs, oracleErrs)
 		}
 
-		if h%(lenSimulation/100) == 0 {
-			fmt.Fprintf(os.Stderr, "%d%% ", h*100/lenSimulation)
+		if progress != nil && h%(lenSimulation/100) == 0 {
+			progress(h * 100 / lenSimulation)
 		}
 	}
-	fmt.Fprintf(os.Stderr, "\n\n")
 
-	end := time.Now()
-	diff := time.Duration(end.UnixNano() - start.UnixNano())
-	fmt.Fprintf(os.Stderr, "Total time: %s\n", diff.String())
+	return &simRun{
+		tc:               actualTest,
+		seed:             seed,
+		sim:              sim,
+		estimator:        estimator,
+		refEstimator:     refEstimator,
+		estimatesHistory: estimatesHistory,
+		duration:         time.Since(start),
+		height:           lenSimulation - 1,
+		oracle:           oracle,
+		oracleErrors:     oracleErrs,
+		latency:          latency,
+		memPoolChecks:    checks,
+	}
+}
+
+// report prints the results of the simulation: the estimates for the target
+// confirmations of the test case, the histograms of the simulated data and the
+// internal state of the estimator.
+func (run *simRun) report(w io.Writer) {
+	actualTest, sim, estimator := run.tc, run.sim, run.estimator
 
 	// Simulation has ended (eg: full node has synced)
 	// Let's now try to estimate the fees.
 
-	fmt.Println("=== Test Case Setup ===")
-	fmt.Printf("%+v\n\n", actualTest)
+	fmt.Fprintln(w, "=== Test Case Setup ===")
+	fmt.Fprintln(w, actualTest.setupString())
+	fmt.Fprintf(w, "Estimator: decay %.6f (half-life %.1f blocks), success pct "+
+		"%.2f, min tx count %g\n", estimator.decay,
+		estimator.decayHalfLife(), estimator.successPct, estimator.minTxCount)
+	fmt.Fprintf(w, "Bucket layout: %s\n", estimator.layoutString())
+	fmt.Fprintf(w, "Confirmation ranges: %s\n\n",
+		estimator.confirmRangesString())
 
 	// Let's try generating fee rate estimates for a number of different target
 	// ranges at the same success pct (this is roughly what bitcoin core does)
-	fmt.Println("=== Fees to use for target confirmations ===")
-	successPct := 0.95
+	fmt.Fprintln(w, "=== Fees to use for target confirmations ===")
 	l1 := ""
 	l2 := ""
 	for _, t := range actualTest.testTargetConfs {
 		l1 += fmt.Sprintf("%12d", t)
-		fee, err := estimator.estimateMedianFee(t, successPct)
-		if err != nil {
-			if err == ErrNoSuccessPctBucketFound {
-				l2 += "   noSuccBkt"
-			} else if err == ErrNotEnoughTxsForEstimate {
-				l2 += "   notEnghTx"
-			} else if _, is := err.(ErrTargetConfTooLarge); is {
-				l2 += " cftTooLarge"
-			} else {
-				l2 += "         err"
-			}
-		} else {
-			l2 += fmt.Sprintf("%12.8f", fee/1e8)
+		l2 += formatEstimate(estimator.estimateMedianFee(t, estimator.successPct))
+	}
+	fmt.Fprintf(w, "%s\n%s\n", l1, l2)
+
+	// Targets beyond the tracked confirmation ranges all get the same
+	// open-ended estimate
+	fmt.Fprintf(w, "Open-ended estimate (targets of %d or more blocks): %s\n\n",
+		estimator.maxConfirms, strings.TrimSpace(formatEstimate(
+			estimator.estimateMedianFee(estimator.maxConfirms,
+				estimator.successPct))))
+
+	// Other fee rates of the passing bucket ranges, for wallets offering
+	// slow/normal/fast options
+	fmt.Fprintln(w, "=== Fee estimate modes for target confirmations ===")
+	fmt.Fprintf(w, "%8s%s\n", "mode", l1)
+	for m := EstimateMode(0); m < numEstimateModes; m++ {
+		l := fmt.Sprintf("%8s", m)
+		for _, t := range actualTest.testTargetConfs {
+			l += formatEstimate(estimator.estimateFee(t, estimator.successPct, m))
 		}
+		fmt.Fprintln(w, l)
+	}
+	fmt.Fprintln(w)
+
+	// Compare the estimates with the fee rates that actually worked
+	fmt.Fprintln(w, "=== Ground truth oracle ===")
+	run.reportOracle(w)
+
+	// And the other way around: how likely some fee rates are to work
+	fmt.Fprintln(w, "=== Confirmation probability by fee rate ===")
+	reportConfirmationProbabilities(w, estimator, actualTest.testTargetConfs)
+
+	// Show how the estimates evolved during the simulation, to check for
+	// stability and convergence (specially when wallets follow the estimator)
+	fmt.Fprintln(w, "=== Fees to use for target confirmations over time ===")
+	l1 = fmt.Sprintf("%8s", "height")
+	for _, t := range actualTest.testTargetConfs {
+		l1 += fmt.Sprintf("%12d", t)
+	}
+	fmt.Fprintln(w, l1)
+	for _, l := range run.estimatesHistory {
+		fmt.Fprintln(w, l)
+	}
+	fmt.Fprintln(w)
+
+	if run.refEstimator != nil {
+		fmt.Fprintln(w, "=== Attack impact ===")
+		reportAttackImpact(w, estimator, run.refEstimator,
+			actualTest.testTargetConfs, estimator.successPct)
 	}
-	fmt.Printf("%s\n%s\n\n", l1, l2)
 
 	// report the histogram of the simulated transactions to see if they are
 	// reasonable
-	fmt.Println("=== Histograms for simulated data ===")
-	sim.reportSimHistograms()
+	fmt.Fprintln(w, "=== Histograms for simulated data ===")
+	sim.reportSimHistograms(w)
+
+	fmt.Fprintln(w, "=== Confirmation latency by fee rate band ===")
+	run.reportLatency(w)
+
+	if len(actualTest.simCfg.miners) > 0 {
+		fmt.Fprintln(w, "=== Miner population ===")
+		sim.reportMiners(w)
+	}
 
 	// Let's see the internal state of the estimator
-	fmt.Println("=== Internal Estimator State ===")
-	fmt.Println(estimator.dumpBuckets())
+	fmt.Fprintln(w, "=== Internal Estimator State ===")
+	fmt.Fprintln(w, estimator.dumpBuckets())
 }
+
+// formatEstimate formats the result of a fee estimation as a fixed width
+// column (in DCR/KB) or as a short description of the error.
+func formatEstimate(fee feeRate, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%12s", estimateErrCode(err))
+	}
+	return fmt.Sprintf("%12.8f", fee/1e8)
+}
+
+// reportConfirmationProbabilities prints the estimated probability of txs
+// paying each of the probeFeeRates being confirmed within the target
+// confirmations, along with the expected number of blocks until confirmation.
+func reportConfirmationProbabilities(w io.Writer, estimator *FeeEstimator,
+	targets []int32) {
+
+	l := fmt.Sprintf("%12s", "fee rate")
+	for _, t := range targets {
+		l += fmt.Sprintf("%8d", t)
+	}
+	fmt.Fprintf(w, "%s%10s\n", l, "expected")
+	for _, rate := range probeFeeRates {
+		l = fmt.Sprintf("%12.8f", rate.ToCoin())
+		est, err := estimator.ConfirmationProbability(rate)
+		if err != nil {
+			fmt.Fprintf(w, "%s %s\n", l, estimateErrCode(err))
+			continue
+		}
+		for _, t := range targets {
+			l += fmt.Sprintf("%7.2f%%", est.SuccessPct[estimator.targetRange(t)]*100)
+		}
+		fmt.Fprintf(w, "%s%10.2f\n", l, est.ExpectedBlocks)
+	}
+	fmt.Fprintln(w)
+}
+
+// estimateErrCode returns a short description of an error returned by the
+// estimator.
+func estimateErrCode(err error) string {
+	if err == ErrNoSuccessPctBucketFound {
+		return "noSuccBkt"
+	} else if err == ErrNotEnoughTxsForEstimate {
+		return "notEnghTx"
+	} else if err == ErrFeeRateTooLow {
+		return "feeTooLow"
+	}
+	return "err"
+}
+
+// updateEstimator updates an estimator with the events of a simulated block:
+// the txs broadcast right before the block was found, the block itself, the txs
+// pruned from the mempool, the txs published after the block and the txs
+// evicted from the mempool. Only the txs for which seen returns true are
+// relayed to the node running the estimator.
+func updateEstimator(estimator *FeeEstimator, block *dcrutil.Block, preBlock,
+	removed, published, evicted []*simTx, seen func(tx *simTx) bool) {
+
+	for _, tx := range preBlock {
+		if seen(tx) {
+			estimator.AddMemPoolTransactionWithAncestors(&tx.txHash,
+				int64(tx.fee), int64(tx.size), int64(tx.ancestorFee),
+				int64(tx.ancestorSize))
+		}
+	}
+
+	estimator.ProcessBlock(block)
+	for _, tx := range removed {
+		estimator.RemoveMemPoolTransaction(&tx.txHash)
+	}
+
+	// This would happen as new transactions are entering the memPool
+	for _, tx := range published {
+		if seen(tx) {
+			estimator.AddMemPoolTransactionWithAncestors(&tx.txHash,
+				int64(tx.fee), int64(tx.size), int64(tx.ancestorFee),
+				int64(tx.ancestorSize))
+		}
+	}
+	for _, tx := range evicted {
+		estimator.RemoveMemPoolTransaction(&tx.txHash)
+	}
+}
+
+// seenByNode returns whether a tx is relayed to the node running the estimator.
+func seenByNode(tx *simTx) bool { return !tx.hidden }
+
+// isHonestTx returns whether a tx was created by an honest user.
+func isHonestTx(tx *simTx) bool { return tx.attacker == nil }
@@ -0,0 +1,180 @@
+// Mempool module. This limits the outstanding transactions of the simulated
+// mempool, removing transactions that expired, that have been waiting for too
+// long or that pay the lowest fee rates once the mempool is full.
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// removalReason is the reason for a transaction to be removed from the
+// simulated mempool without being mined.
+type removalReason int
+
+const (
+	// removalExpired is used for txs that reached their expiry height
+	removalExpired removalReason = iota
+
+	// removalAged is used for txs that stayed in the mempool for longer than
+	// the maximum allowed age
+	removalAged
+
+	// removalEvicted is used for txs evicted from a full mempool due to
+	// paying the lowest fee rates
+	removalEvicted
+
+	// removalStakeDiff is used for tickets that were not mined before the
+	// ticket price changed
+	removalStakeDiff
+
+	numRemovalReasons
+)
+
+var removalReasonNames = [numRemovalReasons]string{
+	removalExpired:   "expired",
+	removalAged:      "aged",
+	removalEvicted:   "evicted",
+	removalStakeDiff: "stakediff",
+}
+
+func (r removalReason) String() string {
+	return removalReasonNames[r]
+}
+
+// removalStats tracks the txs removed from the mempool for a given reason.
+type removalStats struct {
+	txCount    int
+	totalSize  uint64
+	feeRateSum float64
+	ageSum     uint64
+}
+
+// isExpired returns whether the tx can't be included in a block at the given
+// height due to its expiry. This follows the decred rule where a tx with a non
+// zero expiry can only be included in blocks with a lower height.
+func (tx *simTx) isExpired(height uint32) bool {
+	return tx.expiry != 0 && height >= tx.expiry
+}
+
+// add accounts for a tx removed from the mempool at the given height.
+func (stats *removalStats) add(tx *simTx, currentHeight uint32) {
+	stats.txCount++
+	stats.totalSize += uint64(tx.size)
+	stats.feeRateSum += float64(tx.feeRate)
+	stats.ageSum += uint64(currentHeight - tx.genHeight)
+}
+
+// trackRemoval accounts for a tx removed from the mempool by the given reason.
+func (sim *simulator) trackRemoval(tx *simTx, reason removalReason, currentHeight uint32) {
+	sim.removals[reason].add(tx, currentHeight)
+	sim.memPoolSize -= uint64(tx.size)
+}
+
+// pruneMemPool removes the txs that can't be included in a block at the given
+// height because they have expired or have been in the mempool for longer than
+// the maximum configured age, along with their descendants. This includes
+// tickets that can't be mined due to a change in the ticket price.
+func (sim *simulator) pruneMemPool(currentHeight uint32, memPool *txPool) []*simTx {
+	removed := sim.pruneTicketPool(currentHeight)
+	if sim.cfg.expiryFraction <= 0 && sim.cfg.maxTxAge == 0 {
+		return removed
+	}
+
+	doomed := make(map[*simTx]removalReason)
+	for _, tx := range *memPool {
+		var reason removalReason
+		switch {
+		case tx.isExpired(currentHeight):
+			reason = removalExpired
+		case sim.cfg.maxTxAge > 0 && currentHeight-tx.genHeight > sim.cfg.maxTxAge:
+			reason = removalAged
+		default:
+			continue
+		}
+		doomed[tx] = reason
+		for _, d := range tx.descendantsInPool() {
+			if _, is := doomed[d]; !is {
+				doomed[d] = reason
+			}
+		}
+	}
+	if len(doomed) == 0 {
+		return removed
+	}
+
+	memPool.removeWhere(func(tx *simTx) bool {
+		reason, is := doomed[tx]
+		if is {
+			sim.trackRemoval(tx, reason, currentHeight)
+			removed = append(removed, tx)
+		}
+		return is
+	})
+
+	return removed
+}
+
+// limitMemPool evicts the txs paying the lowest fee rates (along with their
+// descendants) until the total size of the mempool is below the maximum
+// configured size.
+func (sim *simulator) limitMemPool(currentHeight uint32, memPool *txPool) []*simTx {
+	defer func() {
+		if sim.memPoolSize > sim.maxMemPoolSizeSeen {
+			sim.maxMemPoolSizeSeen = sim.memPoolSize
+		}
+	}()
+
+	maxSize := uint64(sim.cfg.maxMemPoolSize)
+	if maxSize == 0 || sim.memPoolSize <= maxSize {
+		return nil
+	}
+
+	// A slice sorted by the heap ordering is also a valid heap, so after
+	// sorting we can just drop the txs at the end.
+	sort.Sort(memPool)
+	var evicted []*simTx
+	doomed := make(map[*simTx]struct{})
+	evict := func(tx *simTx) {
+		if _, is := doomed[tx]; is {
+			return
+		}
+		doomed[tx] = struct{}{}
+		sim.trackRemoval(tx, removalEvicted, currentHeight)
+		evicted = append(evicted, tx)
+	}
+	for i := memPool.Len() - 1; sim.memPoolSize > maxSize && i >= 0; i-- {
+		tx := (*memPool)[i]
+		evict(tx)
+		for _, d := range tx.descendantsInPool() {
+			evict(d)
+		}
+	}
+	memPool.removeWhere(func(tx *simTx) bool {
+		_, is := doomed[tx]
+		return is
+	})
+
+	return evicted
+}
+
+// reportMemPoolRemovals prints the stats of the txs removed from the mempool
+// without being mined.
+func (sim *simulator) reportMemPoolRemovals(w io.Writer) {
+	fmt.Fprintf(w, "Mempool Removals\n")
+	fmt.Fprintf(w, "%10s %10s %10s %12s %10s\n", "Reason", "Txs", "KB",
+		"AvgFeeRate", "AvgAge")
+	for r := removalReason(0); r < numRemovalReasons; r++ {
+		stats := &sim.removals[r]
+		txs := float64(stats.txCount)
+		if txs == 0 {
+			txs = 1
+		}
+		fmt.Fprintf(w, "%10s %10d %10.2f %12.8f %10.2f\n", r, stats.txCount,
+			float64(stats.totalSize)/1000, stats.feeRateSum/txs/1e8,
+			float64(stats.ageSum)/txs)
+	}
+	fmt.Fprintf(w, "  largest mempool size = %.2f KB\n",
+		float64(sim.maxMemPoolSizeSeen)/1000)
+}
@@ -0,0 +1,303 @@
+// Miner module. This decides which of the outstanding mempool transactions get
+// included in a newly mined block.
+//
+// The behavior of the miner is controlled by a minerPolicy. The zero value of
+// the policy reproduces the original (and simplest) miner: sort txs by fee rate
+// and include them until the first tx that doesn't fit the block.
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// minSimTxSize is the size of the smallest transaction generated by the
+	// simulator. Once the remaining space in a block is lower than this, there
+	// is no point in looking for more transactions to include.
+	minSimTxSize = 217
+)
+
+// minerPolicy configures how a simulated miner selects transactions from the
+// mempool.
+type minerPolicy struct {
+	// fillBlock makes the miner keep looking for smaller transactions that
+	// still fit in the block after finding one that doesn't, instead of
+	// stopping at the first such transaction.
+	fillBlock bool
+
+	// prioritySize is the size (in bytes) of the area of the block reserved for
+	// high priority transactions, which are included regardless of the fee
+	// rate they pay. Older transactions have higher priority (a rough
+	// approximation of the coin age based priority rules).
+	prioritySize uint32
+
+	// minFeeRate is the minimum fee rate (in atoms/KB) a transaction needs to
+	// pay to be included outside of the priority area.
+	minFeeRate uint32
+
+	// softBlockSize is the maximum size (in bytes) of the blocks created by the
+	// miner (including stake transactions). If zero, blocks are filled up to
+	// maxBlockPayload.
+	softBlockSize uint32
+
+	// stakeReserve is the size (in bytes) of the area of the block reserved for
+	// stake transactions, which regular transactions are not allowed to use
+	// even if the stake transactions of the block don't fill it.
+	stakeReserve uint32
+
+	// emptyBlockRate is the fraction of blocks created by the miner that don't
+	// include any regular transaction (eg: because the miner starts working on
+	// a new block before validating the previous one).
+	emptyBlockRate float64
+}
+
+// regularTxsSpace returns the maximum total size of the regular transactions a
+// miner following this policy includes in a block with stakeSize bytes of stake
+// transactions.
+func (p *minerPolicy) regularTxsSpace(stakeSize uint32) uint32 {
+	space := maxBlockPayload
+	if p.softBlockSize > 0 && p.softBlockSize < space {
+		space = p.softBlockSize
+	}
+	if p.stakeReserve > stakeSize {
+		stakeSize = p.stakeReserve
+	}
+	if stakeSize >= space {
+		return 0
+	}
+	return space - stakeSize
+}
+
+// minePriorityArea selects the oldest transactions in the mempool up until the
+// priority area of the block is full. Txs are only selected after all of their
+// unconfirmed ancestors. The selected transactions are removed from the
+// mempool.
+func (sim *simulator) minePriorityArea(policy *minerPolicy, maxSize,
+	currentHeight uint32, memPool *txPool) ([]*simTx, uint32) {
+
+	areaSize := policy.prioritySize
+	if areaSize > maxSize {
+		areaSize = maxSize
+	}
+
+	byAge := make([]*simTx, memPool.Len())
+	copy(byAge, *memPool)
+	sort.SliceStable(byAge, func(i, j int) bool {
+		return byAge[i].genHeight < byAge[j].genHeight
+	})
+
+	sumSize := uint32(0)
+	mined := make([]*simTx, 0)
+	for _, tx := range byAge {
+		if tx.parent != nil {
+			// the parent of the tx is still unconfirmed (once a tx is mined
+			// its children are unlinked from it)
+			continue
+		}
+		if sumSize+tx.size > areaSize {
+			if !policy.fillBlock || areaSize-sumSize < minSimTxSize {
+				break
+			}
+			continue
+		}
+		sim.txMined(tx, currentHeight, memPool)
+		mined = append(mined, tx)
+		sumSize += tx.size
+	}
+
+	if len(mined) == 0 {
+		return mined, 0
+	}
+
+	memPool.removeWhere(func(tx *simTx) bool { return tx.minedHeight != 0 })
+
+	return mined, sumSize
+}
+
+// mineByFeeRate selects transactions from the mempool in fee rate order, given
+// that sumSize bytes of the block have already been used. A tx with
+// unconfirmed ancestors is mined along with them, as a package. The selected
+// transactions are removed from the mempool.
+func (sim *simulator) mineByFeeRate(policy *minerPolicy, maxSize, sumSize,
+	currentHeight uint32, memPool *txPool) []*simTx {
+
+	mined := make([]*simTx, 0)
+	var skipped []*simTx
+
+	for memPool.Len() > 0 {
+		tx := heap.Pop(memPool).(*simTx)
+		if tx.miningRate() < policy.minFeeRate {
+			// all remaining txs pay an even lower fee rate
+			heap.Push(memPool, tx)
+			break
+		}
+
+		// the size of the package includes all unconfirmed ancestors, which
+		// is also enough to guarantee that txs whose ancestors were skipped
+		// in this block are skipped as well
+		pkgSize := tx.size + tx.ancestorSize
+		if sumSize+pkgSize > maxSize {
+			if !policy.fillBlock {
+				heap.Push(memPool, tx)
+				break
+			}
+			skipped = append(skipped, tx)
+			if maxSize-sumSize < minSimTxSize {
+				break
+			}
+			continue
+		}
+
+		if tx.parent != nil {
+			ancestors := tx.unminedAncestors()
+			for _, a := range ancestors {
+				heap.Remove(memPool, a.heapIdx)
+				sim.txMined(a, currentHeight, memPool)
+				mined = append(mined, a)
+			}
+			sim.chainStats.packagesMined++
+			sim.chainStats.ancestorsPulled += len(ancestors)
+		}
+		sim.txMined(tx, currentHeight, memPool)
+		mined = append(mined, tx)
+		sumSize += pkgSize
+	}
+
+	for _, tx := range skipped {
+		heap.Push(memPool, tx)
+	}
+
+	return mined
+}
+
+// simMiner is one of the miners of the simulated network.
+type simMiner struct {
+	// name identifies the miner in the reports
+	name string
+
+	// hashShare is the share of the network hash power controlled by this
+	// miner. Shares are relative to the sum of the shares of all miners.
+	hashShare float64
+
+	// policy is the policy this miner uses to select transactions
+	policy minerPolicy
+}
+
+// minerStats tracks the blocks and transactions mined by a simulated miner.
+type minerStats struct {
+	blocks      int
+	emptyBlocks int
+	txCount     int
+	totalSize   uint64
+	feeRateSum  float64
+	minFeeRate  uint32
+	histTxMined []*histItem
+}
+
+// pickMiner selects the producer of the next block by a random choice weighted
+// by the hash share of each miner and returns its index.
+func (sim *simulator) pickMiner() int {
+	if len(sim.miners) == 1 {
+		// don't waste random values when there's no choice to be made
+		return 0
+	}
+
+	total := float64(0)
+	for _, m := range sim.miners {
+		total += m.hashShare
+	}
+
+	r := sim.rnd.Float64() * total
+	for i, m := range sim.miners {
+		if r < m.hashShare {
+			return i
+		}
+		r -= m.hashShare
+	}
+	return len(sim.miners) - 1
+}
+
+// trackMinedBlock updates the stats of the given miner with a newly mined
+// block.
+func (sim *simulator) trackMinedBlock(minerIdx int, mined []*simTx, currentHeight uint32) {
+	stats := sim.minerStats[minerIdx]
+	stats.blocks++
+	if len(mined) == 0 {
+		stats.emptyBlocks++
+	}
+	for _, tx := range mined {
+		stats.txCount++
+		stats.totalSize += uint64(tx.size)
+		stats.feeRateSum += float64(tx.feeRate)
+		if stats.txCount == 1 || tx.feeRate < stats.minFeeRate {
+			stats.minFeeRate = tx.feeRate
+		}
+
+		mineDelay := currentHeight - tx.genHeight
+		for h := 0; h < len(stats.histTxMined); h++ {
+			if mineDelay <= stats.histTxMined[h].value {
+				stats.histTxMined[h].count++
+				break
+			}
+		}
+	}
+}
+
+// reportMiners prints the stats for each miner of the simulated population,
+// including the mining interval histogram of the txs mined by each one. This
+// can be used to verify how the different mining policies contribute to the
+// confirmation ranges tracked by the estimator.
+func (sim *simulator) reportMiners(w io.Writer) {
+	fmt.Fprintf(w, "%-12s %8s %8s %8s %10s %10s %12s %12s\n", "Miner",
+		"Share%", "Blocks%", "Empty%", "Txs/Blk", "KB/Blk", "MinFeeRate",
+		"AvgFeeRate")
+
+	totalShare := float64(0)
+	for _, m := range sim.miners {
+		totalShare += m.hashShare
+	}
+
+	for i, m := range sim.miners {
+		stats := sim.minerStats[i]
+		blocks := float64(stats.blocks)
+		if blocks == 0 {
+			blocks = 1
+		}
+		txs := float64(stats.txCount)
+		if txs == 0 {
+			txs = 1
+		}
+		fmt.Fprintf(w, "%-12s %8.2f %8.2f %8.2f %10.2f %10.2f %12.8f %12.8f\n",
+			m.name, m.hashShare*100/totalShare,
+			float64(stats.blocks)*100/float64(sim.totalBlockCount),
+			float64(stats.emptyBlocks)*100/blocks,
+			float64(stats.txCount)/blocks,
+			float64(stats.totalSize)/1000/blocks,
+			float64(stats.minFeeRate)/1e8, stats.feeRateSum/txs/1e8)
+	}
+
+	fmt.Fprintf(w, "\nMining Interval Histogram by Miner (%% of txs mined by each "+
+		"miner)\n")
+	l1 := fmt.Sprintf("%-12s", "")
+	for _, h := range sim.minerStats[0].histTxMined {
+		l1 += fmt.Sprintf("%11d", h.value)
+	}
+	fmt.Fprintln(w, l1)
+	for i, m := range sim.miners {
+		stats := sim.minerStats[i]
+		txs := float64(stats.txCount)
+		if txs == 0 {
+			txs = 1
+		}
+		l := fmt.Sprintf("%-12s", m.name)
+		for _, h := range stats.histTxMined {
+			l += fmt.Sprintf("%11.2f", float64(h.count)*100/txs)
+		}
+		fmt.Fprintln(w, l)
+	}
+
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,260 @@
+// Monte Carlo module. This runs the simulation of a test case across a number
+// of different seeds and aggregates the results, so that changes to the
+// algorithm can be told apart from the noise of a single simulation run.
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+const (
+	// defaultMCRuns is the number of runs of a Monte Carlo simulation when
+	// not specified
+	defaultMCRuns = 10
+)
+
+// runSummary is the subset of the results of a simulation run aggregated by
+// Monte Carlo simulations.
+type runSummary struct {
+	seed int64
+
+	// estimates and estimateErrs are the final estimates (and the errors
+	// returned by the estimator) for each target confirmation of the test case
+	estimates    []feeRate
+	estimateErrs []error
+
+	memPoolFillPct   float64
+	longestMineDelay float64
+	minedTxsPerBlock float64
+
+	// histTxMined is the % of mined txs on each bucket of the mining interval
+	// histogram
+	histTxMined []float64
+}
+
+// summarize returns the summary of a simulation run.
+func (run *simRun) summarize() *runSummary {
+	sim := run.sim
+	targets := run.tc.testTargetConfs
+	sum := &runSummary{
+		seed:         run.seed,
+		estimates:    make([]feeRate, len(targets)),
+		estimateErrs: make([]error, len(targets)),
+		histTxMined:  make([]float64, len(sim.histTxMined)),
+	}
+	for i, t := range targets {
+		sum.estimates[i], sum.estimateErrs[i] = run.estimator.estimateMedianFee(t,
+			run.estimator.successPct)
+	}
+
+	blocks := float64(sim.totalBlockCount)
+	sum.memPoolFillPct = float64(sim.mempoolFillCount) * 100 / blocks
+	sum.longestMineDelay = float64(sim.longestMineDelay)
+
+	minedTxs := float64(0)
+	for _, h := range sim.histTxMined {
+		minedTxs += float64(h.count)
+	}
+	sum.minedTxsPerBlock = minedTxs / blocks
+	if minedTxs == 0 {
+		minedTxs = 1
+	}
+	for i, h := range sim.histTxMined {
+		sum.histTxMined[i] = float64(h.count) * 100 / minedTxs
+	}
+
+	return sum
+}
+
+// sampleStats are the descriptive statistics of a sample of values.
+type sampleStats struct {
+	sorted []float64
+	mean   float64
+	stddev float64
+}
+
+// newSampleStats returns the stats for the given values.
+func newSampleStats(values []float64) *sampleStats {
+	stats := &sampleStats{sorted: make([]float64, len(values))}
+	copy(stats.sorted, values)
+	sort.Float64s(stats.sorted)
+	if len(values) == 0 {
+		return stats
+	}
+
+	for _, v := range values {
+		stats.mean += v
+	}
+	stats.mean /= float64(len(values))
+
+	if len(values) > 1 {
+		for _, v := range values {
+			stats.stddev += (v - stats.mean) * (v - stats.mean)
+		}
+		stats.stddev = math.Sqrt(stats.stddev / float64(len(values)-1))
+	}
+
+	return stats
+}
+
+// percentile returns the value at the given percentile (0-100) of the sample,
+// using the nearest rank method.
+func (stats *sampleStats) percentile(p float64) float64 {
+	if len(stats.sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(stats.sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return stats.sorted[rank]
+}
+
+// runMonteCarlo runs the simulation of the given test case once for each seed
+// in [defaultSeed, defaultSeed+runs), using up to workers parallel goroutines.
+// The first run is thus the same as a single run of the test case. progress is
+// called (from a single goroutine) each time a run completes.
+func runMonteCarlo(tc *testCase, runs, workers int, progress func(done int)) []*runSummary {
+	summaries := make([]*runSummary, runs)
+	seeds := make(chan int)
+	done := make(chan int)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range seeds {
+				// only the summary is kept, so that the state of the simulator
+				// of each run can be released once it completes
+				run := runSimulation(tc, defaultSeed+int64(i), false, nil)
+				summaries[i] = run.summarize()
+				done <- i
+			}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < runs; i++ {
+			seeds <- i
+		}
+		close(seeds)
+	}()
+
+	for i := 0; i < runs; i++ {
+		<-done
+		progress(i + 1)
+	}
+
+	return summaries
+}
+
+// reportMonteCarlo prints the aggregated results of the runs of a Monte Carlo
+// simulation of the given test case.
+func reportMonteCarlo(w io.Writer, tc *testCase, summaries []*runSummary) {
+	fmt.Fprintln(w, "=== Test Case Setup ===")
+	fmt.Fprintf(w, "%s\n\n", tc.setupString())
+
+	fmt.Fprintf(w, "=== Monte Carlo: %d runs (seeds 0x%x-0x%x) ===\n\n",
+		len(summaries), defaultSeed, defaultSeed+len(summaries)-1)
+
+	fmt.Fprintln(w, "=== Fees to use for target confirmations across seeds ===")
+	fmt.Fprintf(w, "%8s%12s%12s%12s%12s%12s%12s%12s%9s\n", "target", "mean",
+		"stddev", "p5", "p25", "p50", "p75", "p95", "failed")
+	for i, t := range tc.testTargetConfs {
+		var values []float64
+		failed := 0
+		for _, sum := range summaries {
+			if sum.estimateErrs[i] != nil {
+				failed++
+				continue
+			}
+			values = append(values, float64(sum.estimates[i])/1e8)
+		}
+		stats := newSampleStats(values)
+		fmt.Fprintf(w, "%8d%12.8f%12.8f%12.8f%12.8f%12.8f%12.8f%12.8f%9d\n", t,
+			stats.mean, stats.stddev, stats.percentile(5),
+			stats.percentile(25), stats.percentile(50),
+			stats.percentile(75), stats.percentile(95), failed)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "=== Simulated data across seeds ===")
+	fmt.Fprintf(w, "%-34s%10s%10s%10s%10s\n", "", "mean", "stddev", "min", "max")
+	reportStat := func(name string, value func(sum *runSummary) float64) {
+		values := make([]float64, len(summaries))
+		for i, sum := range summaries {
+			values[i] = value(sum)
+		}
+		stats := newSampleStats(values)
+		fmt.Fprintf(w, "%-34s%10.2f%10.2f%10.2f%10.2f\n", name, stats.mean,
+			stats.stddev, stats.percentile(0), stats.percentile(100))
+	}
+	reportStat("blocks with mempool left (%)", func(sum *runSummary) float64 {
+		return sum.memPoolFillPct
+	})
+	reportStat("mined txs per block", func(sum *runSummary) float64 {
+		return sum.minedTxsPerBlock
+	})
+	reportStat("longest mine delay (blocks)", func(sum *runSummary) float64 {
+		return sum.longestMineDelay
+	})
+
+	fmt.Fprintf(w, "\nMining Interval Histogram (%% of mined txs)\n")
+	hist := newMiningIntervalHist()
+	for i, h := range hist {
+		name := fmt.Sprintf("<= %d blocks", h.value)
+		if i == len(hist)-1 {
+			name = fmt.Sprintf("> %d blocks", hist[i-1].value)
+		}
+		reportStat(name, func(sum *runSummary) float64 {
+			return sum.histTxMined[i]
+		})
+	}
+	fmt.Fprintln(w)
+}
+
+// mcMain is the entry point of the mc command, which runs a Monte Carlo
+// simulation of a test case. Its arguments are the test case number, the
+// number of runs and the number of parallel workers.
+func mcMain(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: mc <test number> [runs] [workers]")
+		os.Exit(1)
+	}
+
+	tc, err := parseTestCase(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	runs := defaultMCRuns
+	if len(args) > 1 {
+		if runs, err = strconv.Atoi(args[1]); err != nil || runs < 1 {
+			fmt.Println("Please specify a positive number of runs")
+			os.Exit(1)
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if len(args) > 2 {
+		if workers, err = strconv.Atoi(args[2]); err != nil || workers < 1 {
+			fmt.Println("Please specify a positive number of workers")
+			os.Exit(1)
+		}
+	}
+	if workers > runs {
+		workers = runs
+	}
+
+	summaries := runMonteCarlo(tc, runs, workers, func(done int) {
+		fmt.Fprintf(os.Stderr, "%d/%d ", done, runs)
+	})
+	fmt.Fprintf(os.Stderr, "\n\n")
+
+	reportMonteCarlo(os.Stdout, tc, summaries)
+}
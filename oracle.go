@@ -0,0 +1,217 @@
+// Oracle module. The simulator knows exactly when each tx was mined, so it can
+// compute the ground truth for fee estimation: the fee rate that would actually
+// have worked to get a tx confirmed within a target number of blocks. Comparing
+// it to the estimates gives an objective measure of the estimator's accuracy.
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	// oracleWindow is the number of blocks worth of generated txs used by the
+	// oracle to compute the fee rate that would have worked for a target
+	oracleWindow = 288
+
+	// oracleMinTxs is the minimum number of txs paying at least a given fee
+	// rate for the oracle to consider that fee rate
+	oracleMinTxs = 10
+)
+
+// feeOracle tracks the regular txs published by honest users during the last
+// blocks and computes the fee rates that actually worked for them.
+type feeOracle struct {
+	// maxTarget is the highest target confirmation queried from the oracle.
+	// The txs generated up to maxTarget+oracleWindow blocks in the past are
+	// kept.
+	maxTarget uint32
+
+	// txs are the tracked txs, in generation order
+	txs []*simTx
+}
+
+// newFeeOracle returns a new oracle for the given target confirmations.
+func newFeeOracle(targets []int32) *feeOracle {
+	o := &feeOracle{}
+	for _, t := range targets {
+		if uint32(t) > o.maxTarget {
+			o.maxTarget = uint32(t)
+		}
+	}
+	return o
+}
+
+// addTxs tracks newly generated txs.
+func (o *feeOracle) addTxs(txs []*simTx) {
+	o.txs = append(o.txs, txs...)
+}
+
+// prune stops tracking the txs that can't be used anymore by the oracle after
+// the block at the given height.
+func (o *feeOracle) prune(currentHeight uint32) {
+	if currentHeight < o.maxTarget+oracleWindow {
+		return
+	}
+	minHeight := currentHeight - o.maxTarget - oracleWindow + 1
+	i := sort.Search(len(o.txs), func(i int) bool {
+		return o.txs[i].genHeight >= minHeight
+	})
+	o.txs = append(o.txs[:0], o.txs[i:]...)
+}
+
+// feeRate returns the fee rate (in atoms/KB) at which at least successPct of
+// the txs generated during the window of blocks ending targetConfs blocks ago
+// (whose fate is thus known at the given height) were mined within targetConfs
+// blocks. Like the estimator, this starts at the highest fee rate and goes
+// down, returning the lowest fee rate reached before the success rate of the
+// txs paying at least that fee rate falls below successPct. Returns false if
+// no fee rate could be found.
+func (o *feeOracle) feeRate(currentHeight uint32, targetConfs int32,
+	successPct float64) (feeRate, bool) {
+
+	target := uint32(targetConfs)
+	if currentHeight < target {
+		return 0, false
+	}
+	maxHeight := currentHeight - target
+	minHeight := uint32(0)
+	if maxHeight >= oracleWindow {
+		minHeight = maxHeight - oracleWindow + 1
+	}
+
+	var window []*simTx
+	for _, tx := range o.txs {
+		if tx.genHeight >= minHeight && tx.genHeight <= maxHeight {
+			window = append(window, tx)
+		}
+	}
+	sort.Slice(window, func(i, j int) bool {
+		return window[i].feeRate > window[j].feeRate
+	})
+
+	total, success := 0, 0
+	found := false
+	var rate uint32
+	for i := 0; i < len(window); {
+		// account for all txs paying the same fee rate at once
+		current := window[i].feeRate
+		for ; i < len(window) && window[i].feeRate == current; i++ {
+			total++
+			tx := window[i]
+			if tx.minedHeight != 0 && tx.minedHeight-tx.genHeight <= target {
+				success++
+			}
+		}
+		if total < oracleMinTxs {
+			continue
+		}
+		if float64(success)/float64(total) < successPct {
+			if found {
+				break
+			}
+			continue
+		}
+		rate = current
+		found = true
+	}
+
+	return feeRate(rate), found
+}
+
+// oracleErrors accumulates the errors of the estimates for a target
+// confirmation relative to the oracle, sampled during the simulation.
+type oracleErrors struct {
+	samples    int
+	pctSamples int
+	absErrSum  float64
+	absPctSum  float64
+	errSum     float64
+
+	// noEstimate is the number of samples where the oracle found a fee rate
+	// but the estimator failed to provide an estimate
+	noEstimate int
+}
+
+// add accumulates the error of an estimate. The fee rates are in atoms/KB.
+func (e *oracleErrors) add(estimate, oracle feeRate) {
+	diff := float64(estimate - oracle)
+	e.samples++
+	e.absErrSum += math.Abs(diff)
+	e.errSum += diff
+	if oracle > 0 {
+		e.pctSamples++
+		e.absPctSum += math.Abs(diff) * 100 / float64(oracle)
+	}
+}
+
+// mae returns the mean absolute error (in DCR/KB) of the estimates.
+func (e *oracleErrors) mae() float64 {
+	if e.samples == 0 {
+		return 0
+	}
+	return e.absErrSum / float64(e.samples) / 1e8
+}
+
+// mape returns the mean absolute percentage error of the estimates.
+func (e *oracleErrors) mape() float64 {
+	if e.pctSamples == 0 {
+		return 0
+	}
+	return e.absPctSum / float64(e.pctSamples)
+}
+
+// bias returns the mean error (in DCR/KB) of the estimates. Positive values
+// mean the estimator suggests higher fee rates than needed.
+func (e *oracleErrors) bias() float64 {
+	if e.samples == 0 {
+		return 0
+	}
+	return e.errSum / float64(e.samples) / 1e8
+}
+
+// sample compares the current estimates for each target with the oracle at the
+// given height and accumulates the errors.
+func (o *feeOracle) sample(estimator *FeeEstimator, currentHeight uint32,
+	targets []int32, errs []oracleErrors) {
+
+	o.prune(currentHeight)
+	for i, t := range targets {
+		oracleFee, ok := o.feeRate(currentHeight, t, estimator.successPct)
+		if !ok {
+			continue
+		}
+		fee, err := estimator.estimateMedianFee(t, estimator.successPct)
+		if err != nil {
+			errs[i].noEstimate++
+			continue
+		}
+		errs[i].add(fee, oracleFee)
+	}
+}
+
+// reportOracle prints the final estimates next to the fee rates computed by the
+// oracle, along with the error metrics of the estimates sampled during the
+// simulation.
+func (run *simRun) reportOracle(w io.Writer) {
+	estimator := run.estimator
+	fmt.Fprintf(w, "Fee rates at which %.0f%% of the txs generated in a window "+
+		"of %d blocks were mined within the target\n",
+		estimator.successPct*100, oracleWindow)
+	fmt.Fprintf(w, "%8s%12s%12s%12s%10s%12s%9s%9s\n", "target", "estimator",
+		"oracle", "MAE", "MAPE%", "bias", "samples", "noEst")
+	for i, t := range run.tc.testTargetConfs {
+		oracle := "           -"
+		if fee, ok := run.oracle.feeRate(run.height, t, estimator.successPct); ok {
+			oracle = formatEstimate(fee, nil)
+		}
+		errs := &run.oracleErrors[i]
+		fmt.Fprintf(w, "%8d%s%s%12.8f%10.2f%12.8f%9d%9d\n", t,
+			formatEstimate(estimator.estimateMedianFee(t, estimator.successPct)),
+			oracle, errs.mae(), errs.mape(), errs.bias(), errs.samples,
+			errs.noEstimate)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,188 @@
+// Persistence module. This saves the statistics of the estimator along with its
+// bucket layout, so that they can be loaded back (for example, after restarting
+// the node) even if the layout changed in the meantime.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+)
+
+// savedEstimatorVersion is the version of the format of the saved estimators
+const savedEstimatorVersion = 2
+
+// savedBucket holds the statistics of the mined txs of a fee rate bucket.
+type savedBucket struct {
+	ConfirmCount float64   `json:"confirmCount"`
+	FeeSum       float64   `json:"feeSum"`
+	TxCounts     []float64 `json:"txCounts"`
+	FeeSums      []float64 `json:"feeSums"`
+}
+
+// savedMemPoolTx is a mempool tx tracked by the estimator.
+type savedMemPoolTx struct {
+	Hash        string  `json:"hash"`
+	AddedHeight int64   `json:"addedHeight"`
+	FeeRate     float64 `json:"feeRate"`
+}
+
+// savedEstimator is the saved state of an estimator. The bucket and
+// confirmation range bounds don't include the last (+Inf) ones, which can't be
+// encoded as JSON.
+type savedEstimator struct {
+	Version       int              `json:"version"`
+	BestHeight    int64            `json:"bestHeight"`
+	ConfirmRanges []int32          `json:"confirmRanges"`
+	BucketBounds  []float64        `json:"bucketBounds"`
+	PinnedFees    []float64        `json:"pinnedFees"`
+	Buckets       []savedBucket    `json:"buckets"`
+	MemPoolTxs    []savedMemPoolTx `json:"memPoolTxs"`
+}
+
+// Save writes the statistics of the estimator, its bucket layout and the
+// tracked mempool txs (sorted by hash) to w, so that they can be loaded by
+// LoadFeeEstimator.
+func (stats *FeeEstimator) Save(w io.Writer) error {
+
+	// TODO: add lock
+
+	saved := savedEstimator{
+		Version:       savedEstimatorVersion,
+		BestHeight:    stats.bestHeight,
+		ConfirmRanges: stats.confirmBounds,
+		Buckets:       make([]savedBucket, len(stats.buckets)),
+	}
+	for _, b := range stats.bucketFeeBounds[:len(stats.bucketFeeBounds)-1] {
+		saved.BucketBounds = append(saved.BucketBounds, float64(b))
+	}
+	for _, p := range stats.pinnedFees {
+		saved.PinnedFees = append(saved.PinnedFees, float64(p))
+	}
+	// the actual (decayed) values of the stats are saved, leaving the ones
+	// recorded by the estimator untouched
+	scale := stats.decayScale
+	for b := range stats.buckets {
+		bucket := &stats.buckets[b]
+		sb := &saved.Buckets[b]
+		sb.ConfirmCount = bucket.confirmCount * scale
+		sb.FeeSum = bucket.feeSum * scale
+		for _, conf := range bucket.confirmed {
+			sb.TxCounts = append(sb.TxCounts, conf.txCount*scale)
+			sb.FeeSums = append(sb.FeeSums, conf.feeSum*scale)
+		}
+	}
+	for hash, desc := range stats.memPoolTxs {
+		saved.MemPoolTxs = append(saved.MemPoolTxs, savedMemPoolTx{
+			Hash:        hash.String(),
+			AddedHeight: desc.addedHeight,
+			FeeRate:     float64(desc.fees),
+		})
+	}
+	// sorted so that saving the same estimator gives the same output
+	sort.Slice(saved.MemPoolTxs, func(i, j int) bool {
+		return saved.MemPoolTxs[i].Hash < saved.MemPoolTxs[j].Hash
+	})
+
+	return json.NewEncoder(w).Encode(&saved)
+}
+
+// LoadFeeEstimator returns a new estimator for the given config with the
+// statistics previously saved by Save. If the bucket layout of the config
+// differs from the saved one (eg, because the pinned fee rates changed), the
+// statistics of each saved bucket are moved to the new bucket holding its
+// average fee rate, and the mempool txs are tracked in the bucket of their fee
+// rate (or dropped if it is now below the minimum).
+func LoadFeeEstimator(cfg *FeeEstimatorConfig, r io.Reader) (*FeeEstimator, error) {
+	stats, err := NewFeeEstimator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedEstimator
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return nil, err
+	}
+	if saved.Version != savedEstimatorVersion {
+		return nil, fmt.Errorf("unknown saved estimator version %d",
+			saved.Version)
+	}
+	sameRanges := len(saved.ConfirmRanges) == len(stats.confirmBounds)
+	for i := 0; sameRanges && i < len(saved.ConfirmRanges); i++ {
+		sameRanges = saved.ConfirmRanges[i] == stats.confirmBounds[i]
+	}
+	if !sameRanges {
+		return nil, fmt.Errorf("saved estimator tracks confirmation ranges "+
+			"%v instead of %v", saved.ConfirmRanges, stats.confirmBounds)
+	}
+	if len(saved.Buckets) != len(saved.BucketBounds)+1 {
+		return nil, fmt.Errorf("saved estimator has %d buckets for %d bounds",
+			len(saved.Buckets), len(saved.BucketBounds))
+	}
+
+	sameLayout := len(saved.BucketBounds) == len(stats.bucketFeeBounds)-1
+	for i := 0; sameLayout && i < len(saved.BucketBounds); i++ {
+		sameLayout = saved.BucketBounds[i] == float64(stats.bucketFeeBounds[i])
+	}
+	if !sameLayout {
+		feesLog.Infof("Moving saved stats from %d to %d buckets",
+			len(saved.Buckets), len(stats.buckets))
+	}
+
+	for b, sb := range saved.Buckets {
+		nbRanges := len(stats.confirmBounds) + 1
+		if len(sb.TxCounts) != nbRanges || len(sb.FeeSums) != nbRanges {
+			return nil, fmt.Errorf("saved bucket %d has the wrong number of "+
+				"confirmation ranges", b)
+		}
+
+		// The whole bucket (its totals and every confirmation range) is
+		// moved to a single bucket, so that the ranges are still cumulative
+		// and the last one still holds every mined tx.
+		target := b
+		if !sameLayout {
+			target = int(stats.lowerBucket(avgFeeRate(sb.FeeSum,
+				sb.ConfirmCount)))
+		}
+		stats.buckets[target].confirmCount += sb.ConfirmCount
+		stats.buckets[target].feeSum += sb.FeeSum
+		for c := range sb.TxCounts {
+			conf := &stats.buckets[target].confirmed[c]
+			conf.txCount += sb.TxCounts[c]
+			conf.feeSum += sb.FeeSums[c]
+		}
+	}
+
+	stats.bestHeight = saved.BestHeight
+	for _, tx := range saved.MemPoolTxs {
+		hash, err := chainhash.NewHashFromStr(tx.Hash)
+		if err != nil {
+			return nil, err
+		}
+		rate := feeRate(tx.FeeRate)
+		if rate < stats.bucketFeeBounds[0] {
+			continue
+		}
+		stats.memPoolTxs[*hash] = memPoolTxDesc{
+			addedHeight: tx.AddedHeight,
+			bucketIndex: stats.lowerBucket(rate),
+			fees:        rate,
+		}
+	}
+	stats.ResyncMemPool()
+
+	return stats, nil
+}
+
+// avgFeeRate returns the average fee rate of txs with the given fee rate sum
+// and count, or zero if there are none.
+func avgFeeRate(feeSum, txCount float64) feeRate {
+	if txCount <= 0 || math.IsNaN(feeSum) {
+		return 0
+	}
+	return feeRate(feeSum / txCount)
+}
@@ -0,0 +1,366 @@
+// Report module. This saves the results of simulation runs in a structured
+// (JSON) format and renders them as a Markdown report, so that the results
+// published in the README always match a real run.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	// baseTestNb is the test case the parameters of the other test cases are
+	// compared to in the generated reports
+	baseTestNb = 1
+
+	// reportBeginMarker and reportEndMarker delimit the section of the README
+	// replaced by the generated report
+	reportBeginMarker = "<!-- BEGIN GENERATED RESULTS -->"
+	reportEndMarker   = "<!-- END GENERATED RESULTS -->"
+)
+
+// stringerType is the type of the fmt.Stringer interface.
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+// paramValue is the value of one of the parameters of a test case.
+type paramValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// estimateResult is the fee rate (in DCR/KB) estimated for a target
+// confirmation or the short description of the error returned by the
+// estimator.
+type estimateResult struct {
+	Target  int32   `json:"target"`
+	FeeRate float64 `json:"feeRate"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// oracleErrorResult are the error metrics (in DCR/KB) of the estimates for a
+// target confirmation relative to the oracle.
+type oracleErrorResult struct {
+	Target     int32   `json:"target"`
+	Samples    int     `json:"samples"`
+	NoEstimate int     `json:"noEstimate"`
+	MAE        float64 `json:"mae"`
+	MAPE       float64 `json:"mape"`
+	Bias       float64 `json:"bias"`
+}
+
+// runResult is the structured output of the simulation of a test case.
+type runResult struct {
+	TestCase    int          `json:"testCase"`
+	Description string       `json:"description"`
+	Seed        int64        `json:"seed"`
+	Params      []paramValue `json:"params"`
+
+	Estimates []estimateResult `json:"estimates"`
+
+	// ReferenceEstimates are the estimates of the reference estimator, which
+	// only sees honest traffic (when the test case includes attackers)
+	ReferenceEstimates []estimateResult `json:"referenceEstimates,omitempty"`
+
+	// Oracle are the fee rates that actually worked at the end of the
+	// simulation and OracleErrors are the errors of the estimates relative to
+	// the oracle, sampled during the simulation
+	Oracle       []estimateResult    `json:"oracle"`
+	OracleErrors []oracleErrorResult `json:"oracleErrors"`
+
+	MemPoolFillPct   float64 `json:"memPoolFillPct"`
+	LongestMineDelay uint32  `json:"longestMineDelay"`
+}
+
+// newEstimateResults returns the estimates of the given estimator for each of
+// the targets.
+func newEstimateResults(estimator *FeeEstimator, targets []int32) []estimateResult {
+	res := make([]estimateResult, len(targets))
+	for i, t := range targets {
+		fee, err := estimator.estimateMedianFee(t, estimator.successPct)
+		res[i].Target = t
+		if err != nil {
+			res[i].Error = estimateErrCode(err)
+			continue
+		}
+		res[i].FeeRate = float64(fee) / 1e8
+	}
+	return res
+}
+
+// result returns the structured output of a run of the given test case.
+func (run *simRun) result(testNb int) *runResult {
+	sim := run.sim
+	res := &runResult{
+		TestCase:    testNb,
+		Description: run.tc.description,
+		Seed:        run.seed,
+		Params:      run.tc.params(),
+		Estimates: newEstimateResults(run.estimator,
+			run.tc.testTargetConfs),
+		MemPoolFillPct: float64(sim.mempoolFillCount) * 100 /
+			float64(sim.totalBlockCount),
+		LongestMineDelay: sim.longestMineDelay,
+	}
+	successPct := run.estimator.successPct
+	for i, t := range run.tc.testTargetConfs {
+		oracle := estimateResult{Target: t, Error: "noData"}
+		if fee, ok := run.oracle.feeRate(run.height, t, successPct); ok {
+			oracle = estimateResult{Target: t, FeeRate: float64(fee) / 1e8}
+		}
+		res.Oracle = append(res.Oracle, oracle)
+
+		errs := &run.oracleErrors[i]
+		res.OracleErrors = append(res.OracleErrors, oracleErrorResult{
+			Target:     t,
+			Samples:    errs.samples,
+			NoEstimate: errs.noEstimate,
+			MAE:        errs.mae(),
+			MAPE:       errs.mape(),
+			Bias:       errs.bias(),
+		})
+	}
+	if run.refEstimator != nil {
+		res.ReferenceEstimates = newEstimateResults(run.refEstimator,
+			run.tc.testTargetConfs)
+	}
+	return res
+}
+
+// params returns the parameters of the test case, named after the path of the
+// corresponding config field (eg: simCfg.stake.ticketsPerWindow).
+func (tc *testCase) params() []paramValue {
+	var params []paramValue
+	params = appendParams(params, "simCfg", reflect.ValueOf(tc.simCfg))
+	params = appendParams(params, "estCfg", reflect.ValueOf(tc.estCfg))
+	params = appendParams(params, "testTargetConfs",
+		reflect.ValueOf(tc.testTargetConfs))
+	return params
+}
+
+// appendParams appends the parameters for the given config value. Nested
+// structs and slices of structs (such as the miners of a test case) are
+// flattened, while other values are formatted as a single parameter.
+func appendParams(params []paramValue, name string, v reflect.Value) []paramValue {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct {
+		for i := 0; i < v.Len(); i++ {
+			params = appendParams(params, fmt.Sprintf("%s[%d]", name, i),
+				v.Index(i))
+		}
+		return params
+	}
+	if v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64 &&
+		v.Type().Implements(stringerType) {
+		// fmt doesn't call the String method of unexported fields (such as
+		// the attack kind), so call it on a copy of the value
+		c := reflect.New(v.Type()).Elem()
+		c.SetInt(v.Int())
+		return append(params, paramValue{Name: name,
+			Value: c.Interface().(fmt.Stringer).String()})
+	}
+	if v.Kind() != reflect.Struct {
+		// fmt is able to format the unexported fields of the configs
+		return append(params, paramValue{Name: name,
+			Value: fmt.Sprintf("%+v", v)})
+	}
+	for i := 0; i < v.NumField(); i++ {
+		params = appendParams(params, name+"."+v.Type().Field(i).Name,
+			v.Field(i))
+	}
+	return params
+}
+
+// isZeroParam returns whether a parameter has the zero value of its type.
+func isZeroParam(p paramValue) bool {
+	switch p.Value {
+	case "0", "0 DCR", "false", "[]", "":
+		return true
+	}
+	return false
+}
+
+// resultsJSONFile returns the path of the structured results file of the given
+// test case.
+func resultsJSONFile(testNb int) string {
+	return filepath.Join(resultsDir, fmt.Sprintf("testcase%02d.json", testNb))
+}
+
+// writeResult writes the structured results file of a run.
+func writeResult(res *runResult) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(resultsJSONFile(res.TestCase), buf.Bytes(), 0644)
+}
+
+// readResults reads the structured results files of all test cases. Test cases
+// without a results file are skipped.
+func readResults() ([]*runResult, error) {
+	var results []*runResult
+	for i := range testCases {
+		b, err := ioutil.ReadFile(resultsJSONFile(i + 1))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res := new(runResult)
+		if err := json.Unmarshal(b, res); err != nil {
+			return nil, fmt.Errorf("unable to decode %s: %v",
+				resultsJSONFile(i+1), err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// writeEstimatesTable writes the estimates in the same format used by the
+// results of single runs.
+func writeEstimatesTable(w io.Writer, estimates []estimateResult) {
+	l1 := ""
+	l2 := ""
+	for _, e := range estimates {
+		l1 += fmt.Sprintf("%12d", e.Target)
+		if e.Error != "" {
+			l2 += fmt.Sprintf("%12s", e.Error)
+		} else {
+			l2 += fmt.Sprintf("%12.8f", e.FeeRate)
+		}
+	}
+	fmt.Fprintf(w, "%s\n%s\n", l1, l2)
+}
+
+// renderMarkdown writes the Markdown report of the given results. The
+// parameters of each test case are listed as deltas relative to the base
+// result (if available).
+func renderMarkdown(w io.Writer, results []*runResult, base *runResult) {
+	baseParams := make(map[string]string)
+	if base != nil {
+		for _, p := range base.Params {
+			baseParams[p.Name] = p.Value
+		}
+	}
+
+	for _, res := range results {
+		fmt.Fprintf(w, "### Test Case %02d\n\n", res.TestCase)
+		job := &batchJob{testNb: res.TestCase}
+		fmt.Fprintf(w, "([Full results](%s), [latency curves](%s)). %s\n\n",
+			filepath.ToSlash(job.resultsFile()),
+			filepath.ToSlash(job.latencyFile()), res.Description)
+
+		if base == nil || res == base {
+			fmt.Fprintf(w, "Parameters:\n\n")
+			for _, p := range res.Params {
+				if !isZeroParam(p) {
+					fmt.Fprintf(w, "- `%s`: %s\n", p.Name, p.Value)
+				}
+			}
+		} else {
+			fmt.Fprintf(w, "Parameters changed from test %02d:\n\n",
+				base.TestCase)
+			for _, p := range res.Params {
+				baseValue, inBase := baseParams[p.Name]
+				switch {
+				case !inBase && !isZeroParam(p):
+					fmt.Fprintf(w, "- `%s`: %s\n", p.Name, p.Value)
+				case inBase && p.Value != baseValue:
+					fmt.Fprintf(w, "- `%s`: %s (was %s)\n", p.Name,
+						p.Value, baseValue)
+				}
+			}
+		}
+		fmt.Fprintf(w, "\nBlocks leaving txs in the mempool after being "+
+			"mined: %.2f%%. Longest mine delay: %d blocks.\n\n",
+			res.MemPoolFillPct, res.LongestMineDelay)
+
+		fmt.Fprintf(w, "```\n=== Fees to use for target confirmations ===\n")
+		writeEstimatesTable(w, res.Estimates)
+		if len(res.Oracle) > 0 {
+			fmt.Fprintf(w, "\n=== Ground truth oracle (and MAPE%% of the "+
+				"estimates) ===\n")
+			writeEstimatesTable(w, res.Oracle)
+			l := ""
+			for _, e := range res.OracleErrors {
+				l += fmt.Sprintf("%12.2f", e.MAPE)
+			}
+			fmt.Fprintln(w, l)
+		}
+		if len(res.ReferenceEstimates) > 0 {
+			fmt.Fprintf(w, "\n=== Fees estimated with honest traffic only "+
+				"===\n")
+			writeEstimatesTable(w, res.ReferenceEstimates)
+		}
+		fmt.Fprintf(w, "```\n\n")
+	}
+}
+
+// replaceReport replaces the section of the document between the report
+// markers with the given report.
+func replaceReport(doc, report string) (string, error) {
+	begin := strings.Index(doc, reportBeginMarker)
+	end := strings.Index(doc, reportEndMarker)
+	if begin < 0 || end < begin {
+		return "", fmt.Errorf("report markers %q and %q not found",
+			reportBeginMarker, reportEndMarker)
+	}
+	return doc[:begin+len(reportBeginMarker)] + "\n\n" + report +
+		doc[end:], nil
+}
+
+// reportMain is the entry point of the report command, which renders the
+// structured results of all test cases (written by the runall command) into
+// the README. Its only (optional) argument is the path of the README.
+func reportMain(args []string) {
+	readme := "README.md"
+	if len(args) > 0 {
+		readme = args[0]
+	}
+
+	results, err := readResults()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(results) == 0 {
+		fmt.Printf("No results found in %s. Use the runall command to "+
+			"generate them.\n", resultsDir)
+		os.Exit(1)
+	}
+
+	var base *runResult
+	for _, res := range results {
+		if res.TestCase == baseTestNb {
+			base = res
+		}
+	}
+
+	var buf bytes.Buffer
+	renderMarkdown(&buf, results, base)
+
+	doc, err := ioutil.ReadFile(readme)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	newDoc, err := replaceReport(string(doc), buf.String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(readme, []byte(newDoc), 0644); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rendered the results of %d test cases into %s\n",
+		len(results), readme)
+}
@@ -0,0 +1,261 @@
+// Batch runner module. This runs the simulation of every test case
+// concurrently and writes the results of each one to its results file.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// resultsDir is the directory where the results of the test cases are
+	// written
+	resultsDir = "results"
+
+	// progressInterval is the interval between updates of the progress view
+	progressInterval = time.Second
+
+	// progressBarWidth is the width (in characters) of the progress bars
+	progressBarWidth = 20
+)
+
+// jobState is the state of a job of the batch runner.
+type jobState int
+
+const (
+	jobPending jobState = iota
+	jobRunning
+	jobDone
+	jobFailed
+)
+
+// batchJob is the simulation of a single test case run by the batch runner.
+type batchJob struct {
+	testNb   int
+	state    jobState
+	pct      uint32
+	duration time.Duration
+	err      error
+}
+
+// resultsFile returns the path of the results file of the test case.
+func (job *batchJob) resultsFile() string {
+	return filepath.Join(resultsDir, fmt.Sprintf("testcase%02d.txt", job.testNb))
+}
+
+// latencyFile returns the path of the latency curves (CSV) file of the test
+// case.
+func (job *batchJob) latencyFile() string {
+	return filepath.Join(resultsDir, fmt.Sprintf("testcase%02d-latency.csv",
+		job.testNb))
+}
+
+// status returns a one line description of the state of the job.
+func (job *batchJob) status() string {
+	switch job.state {
+	case jobRunning:
+		filled := int(job.pct) * progressBarWidth / 100
+		return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled),
+			strings.Repeat(".", progressBarWidth-filled), job.pct)
+	case jobDone:
+		return fmt.Sprintf("done in %s -> %s",
+			job.duration.Round(time.Millisecond), job.resultsFile())
+	case jobFailed:
+		return fmt.Sprintf("FAILED: %v", job.err)
+	}
+	return "pending"
+}
+
+// batchRunner runs the simulation of a set of test cases using a bounded
+// number of workers and tracks the progress of each one.
+type batchRunner struct {
+	mtx  sync.Mutex
+	jobs []*batchJob
+
+	// interactive is whether the progress view is redrawn in place (when
+	// writing to a terminal) or each change of state is printed on its own
+	// line
+	interactive bool
+	out         io.Writer
+	drawnLines  int
+}
+
+// run runs a single job, writing its results files. A panic during the
+// simulation is reported as a failure of the job instead of taking down the
+// other jobs.
+func (r *batchRunner) run(job *batchJob) {
+	r.setState(job, jobRunning, nil)
+
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+
+		tc := &testCases[job.testNb-1]
+		if err := tc.estCfg.Validate(); err != nil {
+			return err
+		}
+		sim := runSimulation(tc, defaultSeed, false,
+			func(pct uint32) {
+				r.mtx.Lock()
+				job.pct = pct
+				r.mtx.Unlock()
+			})
+
+		var buf bytes.Buffer
+		sim.report(&buf)
+		job.duration = sim.duration
+		if err := ioutil.WriteFile(job.resultsFile(), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		buf.Reset()
+		sim.writeLatencyCSV(&buf)
+		if err := ioutil.WriteFile(job.latencyFile(), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		return writeResult(sim.result(job.testNb))
+	}()
+
+	if err != nil {
+		r.setState(job, jobFailed, err)
+		return
+	}
+	r.setState(job, jobDone, nil)
+}
+
+// setState changes the state of a job.
+func (r *batchRunner) setState(job *batchJob, state jobState, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	job.state = state
+	job.err = err
+	if !r.interactive {
+		status := job.status()
+		if state == jobRunning {
+			status = "started"
+		}
+		fmt.Fprintf(r.out, "test %02d %s\n", job.testNb, status)
+	}
+}
+
+// draw redraws the progress view, replacing the previous one.
+func (r *batchRunner) draw() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.drawnLines > 0 {
+		// move the cursor back to the start of the previous view
+		fmt.Fprintf(r.out, "\033[%dA", r.drawnLines)
+	}
+	for _, job := range r.jobs {
+		fmt.Fprintf(r.out, "\033[2Ktest %02d %s\n", job.testNb, job.status())
+	}
+	r.drawnLines = len(r.jobs)
+}
+
+// runAll runs the given jobs using up to workers parallel goroutines. Returns
+// the number of failed jobs.
+func (r *batchRunner) runAll(workers int) int {
+	jobs := make(chan *batchJob)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			for job := range jobs {
+				r.run(job)
+			}
+			wg.Done()
+		}()
+	}
+
+	allDone := make(chan struct{})
+	go func() {
+		for _, job := range r.jobs {
+			jobs <- job
+		}
+		close(jobs)
+		wg.Wait()
+		close(allDone)
+	}()
+
+	if r.interactive {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+	loop:
+		for {
+			r.draw()
+			select {
+			case <-ticker.C:
+			case <-allDone:
+				break loop
+			}
+		}
+		r.draw()
+	} else {
+		<-allDone
+	}
+
+	failed := 0
+	for _, job := range r.jobs {
+		if job.state == jobFailed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// isTerminal returns whether the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// runAllMain is the entry point of the runall command, which runs every test
+// case and writes its results (as text and JSON, plus the latency curves as
+// CSV) to the results dir. Its only (optional) argument is the number of
+// parallel workers. Exits with a non-zero code if any of the test cases fails.
+func runAllMain(args []string) {
+	workers := runtime.NumCPU()
+	if len(args) > 0 {
+		var err error
+		if workers, err = strconv.Atoi(args[0]); err != nil || workers < 1 {
+			fmt.Println("Please specify a positive number of workers")
+			os.Exit(1)
+		}
+	}
+
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	r := &batchRunner{
+		interactive: isTerminal(os.Stderr),
+		out:         os.Stderr,
+	}
+	for i := range testCases {
+		r.jobs = append(r.jobs, &batchJob{testNb: i + 1})
+	}
+
+	start := time.Now()
+	failed := r.runAll(workers)
+	fmt.Fprintf(os.Stderr, "\nTotal time: %s\n", time.Since(start))
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d test cases failed\n", failed,
+			len(r.jobs))
+		os.Exit(1)
+	}
+}
@@ -7,12 +7,14 @@
 //
 // To adjust the rate and size of generated transactions, modify the `simGenTxs`
 // function.
-// To adjust mining behavior, modify the `simMine` function.
+// To adjust mining behavior, use the `minerPolicy` of the test case.
 package main
 
 import (
 	"container/heap"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
 
@@ -24,8 +26,7 @@ import (
 
 var (
 	maxBlockPayload = uint32(chaincfg.MainNetParams.MaximumBlockSizes[0] -
-		wire.MaxBlockHeaderPayload -
-		5*421) // 5 votes
+		wire.MaxBlockHeaderPayload)
 )
 
 type histItem struct {
@@ -33,30 +34,122 @@ type histItem struct {
 	count uint32
 }
 
+// simTxType is the type of a simulated transaction.
+type simTxType byte
+
+const (
+	txTypeRegular simTxType = iota
+	txTypeCoinbase
+	txTypeVote
+	txTypeTicket
+	txTypeRevocation
+)
+
 type simTx struct {
-	size      uint32
-	feeRate   uint32
-	fee       uint32
-	genHeight uint32
-	txHash    chainhash.Hash
+	txType      simTxType
+	size        uint32
+	feeRate     uint32
+	fee         uint32
+	genHeight   uint32
+	minedHeight uint32
+	expiry      uint32
+	txHash      chainhash.Hash
+	msgTx       *wire.MsgTx
+
+	// heapIdx is the index of the tx in its txPool (or -1 if the tx is not
+	// in a pool)
+	heapIdx int
+
+	// parent is the unconfirmed tx this tx spends from (if any) and children
+	// are the txs that spend from this one
+	parent   *simTx
+	children []*simTx
+
+	// ancestorFee, ancestorSize and ancestorCount track the unconfirmed
+	// ancestors of the tx, which need to be mined before (or along with) it
+	ancestorFee   uint32
+	ancestorSize  uint32
+	ancestorCount int
+
+	// attacker is the attacker that created the tx (nil for honest txs) and
+	// hidden is set for honest txs not relayed to the node running the
+	// estimator
+	attacker *attackerConfig
+	hidden   bool
+}
+
+// setMsgTx creates the wire transaction that represents the simulated tx in
+// mined blocks and sets the tx hash accordingly. Only the hash of the tx
+// matters to the estimator, so instead of spending real outputs the tx spends
+// a fake outpoint which uniquely identifies it by its type, generation height,
+// index among the txs of the same type generated at that height and the kind
+// of attack (if any) that created it.
+func (tx *simTx) setMsgTx(idx int) {
+	var prevHash chainhash.Hash
+	prevHash[0] = byte(tx.txType)
+	binary.BigEndian.PutUint32(prevHash[1:], tx.genHeight)
+	binary.BigEndian.PutUint32(prevHash[5:], uint32(idx))
+	if tx.attacker != nil {
+		prevHash[9] = byte(tx.attacker.kind) + 1
+	}
+
+	tree := wire.TxTreeRegular
+	if tx.txType != txTypeRegular && tx.txType != txTypeCoinbase {
+		tree = wire.TxTreeStake
+	}
+
+	msgTx := wire.NewMsgTx()
+	msgTx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: prevHash, Tree: tree},
+		ValueIn:          int64(tx.fee),
+	})
+	msgTx.AddTxOut(&wire.TxOut{})
+	tx.msgTx = msgTx
+	tx.txHash = msgTx.TxHash()
 }
 
+// txPool is a heap of txs, sorted by the fee rate used by miners to select txs.
 type txPool []*simTx
 
-func (s txPool) Len() int            { return len(s) }
-func (s txPool) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
-func (s txPool) Less(i, j int) bool  { return s[i].feeRate > s[j].feeRate }
-func (s *txPool) Push(x interface{}) { *s = append(*s, x.(*simTx)) }
+func (s txPool) Len() int { return len(s) }
+func (s txPool) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].heapIdx = i
+	s[j].heapIdx = j
+}
+func (s txPool) Less(i, j int) bool { return s[i].miningRate() > s[j].miningRate() }
+func (s *txPool) Push(x interface{}) {
+	tx := x.(*simTx)
+	tx.heapIdx = len(*s)
+	*s = append(*s, tx)
+}
 func (s *txPool) Pop() interface{} {
 	old := *s
 	n := len(old)
 	x := old[n-1]
+	old[n-1] = nil
+	x.heapIdx = -1
 	*s = old[0 : n-1]
 	return x
 }
 
-type simBlock struct {
-	dcrutil.Block
+// removeWhere removes from the pool all txs for which the remove function
+// returns true and restores the heap property of the pool.
+func (s *txPool) removeWhere(remove func(tx *simTx) bool) {
+	remaining := (*s)[:0]
+	for _, tx := range *s {
+		if remove(tx) {
+			tx.heapIdx = -1
+			continue
+		}
+		tx.heapIdx = len(remaining)
+		remaining = append(remaining, tx)
+	}
+	for i := len(remaining); i < len(*s); i++ {
+		(*s)[i] = nil
+	}
+	*s = remaining
+	heap.Init(s)
 }
 
 type simulatorConfig struct {
@@ -79,12 +172,89 @@ type simulatorConfig struct {
 	// feeRateHistReportValues are the values to report in fee rate histogram
 	// (automatically calculated if nil)
 	feeRateHistReportValues []uint32
+
+	// minerPolicy is the policy used by the miner to select transactions
+	// from the mempool when creating new blocks
+	minerPolicy minerPolicy
+
+	// estimatorFeeFraction is the fraction of generated transactions that pay
+	// the fee rate suggested by the live estimator (as wallets using it would
+	// do) instead of a fee rate drawn from the fee rate distribution.
+	estimatorFeeFraction float64
+
+	// estimatorMaxTarget is the maximum target confirmation used when asking
+	// the estimator for a fee rate. Each tx uses a random target between 1 and
+	// this value.
+	estimatorMaxTarget int32
+
+	// expiryFraction is the fraction of generated transactions that set an
+	// expiry height
+	expiryFraction float64
+
+	// expiryDelta is the number of blocks after being generated that
+	// transactions with an expiry height expire
+	expiryDelta uint32
+
+	// maxMemPoolSize is the maximum total size (in bytes) of the txs in the
+	// mempool. Once this is exceeded, the txs paying the lowest fee rates are
+	// evicted. If zero, the mempool size is unlimited.
+	maxMemPoolSize uint32
+
+	// maxTxAge is the maximum number of blocks a tx stays in the mempool
+	// before being removed. If zero, txs are kept until they are mined.
+	maxTxAge uint32
+
+	// chainTxFraction is the fraction of generated transactions that spend an
+	// output of an unconfirmed mempool transaction, creating chains of
+	// dependent transactions
+	chainTxFraction float64
+
+	// maxChainDepth is the maximum number of unconfirmed ancestors of a
+	// chained transaction
+	maxChainDepth int
+
+	// cpfpFraction is the fraction of chained transactions that bump the fee
+	// rate of their ancestors (child pays for parent) by paying a fee rate
+	// cpfpFeeRateMult times higher than the generated fee rate
+	cpfpFraction    float64
+	cpfpFeeRateMult float64
+
+	// stake configures the generated stake transactions
+	stake stakeConfig
+
+	// miners is the population of miners of the simulated network. The
+	// producer of each block is chosen by a random choice weighted by the hash
+	// share of each miner. If empty, all blocks are produced by a single miner
+	// using minerPolicy.
+	miners []simMiner
+
+	// attackers are the adversaries trying to manipulate the estimator
+	attackers []attackerConfig
+}
+
+// feeEstimateFunc is the function simulated wallets use to query the fee rate
+// (in atoms/KB) for a tx to be confirmed within targetConfs blocks.
+type feeEstimateFunc func(targetConfs int32) (feeRate, error)
+
+// cachedEstimate is a fee rate estimate returned by the estimator at a given
+// height.
+type cachedEstimate struct {
+	height uint32
+	rate   feeRate
+	err    error
 }
 
 type simulator struct {
 	cfg *simulatorConfig
 	rnd *rand.Rand
 
+	// estimateFee is used to generate txs that follow the fee rate suggested
+	// by the estimator. It must be set if cfg.estimatorFeeFraction > 0.
+	estimateFee     feeEstimateFunc
+	estimateCache   map[int32]cachedEstimate
+	estimatorFeeTxs int
+	fallbackFeeTxs  int
+
 	// histograms for raw generated data
 	histBlockSize    []*histItem
 	histTxSize       []*histItem
@@ -94,12 +264,29 @@ type simulator struct {
 	mempoolFillCount int
 	totalBlockCount  int
 	longestMineDelay uint32
+
+	miners     []simMiner
+	minerStats []*minerStats
+
+	memPoolSize        uint64
+	maxMemPoolSizeSeen uint64
+	removals           [numRemovalReasons]removalStats
+
+	pendingVotes       []*simTx
+	pendingRevocations []*simTx
+	ticketPool         txPool
+	stakeStats         stakeStats
+
+	chainStats chainStats
+
+	attackStats attackStats
 }
 
-func newSimulator(cfg *simulatorConfig) *simulator {
+func newSimulator(cfg *simulatorConfig, seed int64) *simulator {
 	sim := &simulator{
-		cfg: cfg,
-		rnd: rand.New(rand.NewSource(0x1701d)),
+		cfg:           cfg,
+		rnd:           rand.New(rand.NewSource(seed)),
+		estimateCache: make(map[int32]cachedEstimate),
 	}
 
 	// setup the vars that track histograms for the simulator (used to verify
@@ -132,7 +319,25 @@ func newSimulator(cfg *simulatorConfig) *simulator {
 		sim.histTxCount = append(sim.histTxCount, &histItem{value: t})
 	}
 
-	sim.histTxMined = []*histItem{
+	sim.histTxMined = newMiningIntervalHist()
+
+	sim.miners = cfg.miners
+	if len(sim.miners) == 0 {
+		sim.miners = []simMiner{{name: "default", hashShare: 1,
+			policy: cfg.minerPolicy}}
+	}
+	sim.minerStats = make([]*minerStats, len(sim.miners))
+	for i := range sim.miners {
+		sim.minerStats[i] = &minerStats{histTxMined: newMiningIntervalHist()}
+	}
+
+	return sim
+}
+
+// newMiningIntervalHist returns an empty histogram to track the number of
+// blocks transactions took to be mined.
+func newMiningIntervalHist() []*histItem {
+	return []*histItem{
 		&histItem{value: 1},
 		&histItem{value: 2},
 		&histItem{value: 3},
@@ -144,8 +349,6 @@ func newSimulator(cfg *simulatorConfig) *simulator {
 		&histItem{value: 64},
 		&histItem{value: 0x7fffffff},
 	}
-
-	return sim
 }
 
 func (sim *simulator) genTransactions(currentHeight uint32, memPool *txPool) []*simTx {
@@ -162,10 +365,16 @@ func (sim *simulator) genTransactions(currentHeight uint32, memPool *txPool) []*
 	startFee := sim.cfg.minimumFeeRate * 99 / 100
 	for i := 0; i < nbTx; i++ {
 		txs[i] = &simTx{
-			size:      217 + uint32(sim.rnd.ExpFloat64()*sim.cfg.txSizeCoef),
+			size:      minSimTxSize + uint32(sim.rnd.ExpFloat64()*sim.cfg.txSizeCoef),
 			feeRate:   startFee + uint32(math.Floor(sim.rnd.ExpFloat64()*sim.cfg.feeRateCoef)), // atoms/KB
 			genHeight: currentHeight,
 		}
+		if sim.cfg.estimatorFeeFraction > 0 &&
+			sim.rnd.Float64() < sim.cfg.estimatorFeeFraction {
+			if rate, ok := sim.walletFeeRate(currentHeight); ok {
+				txs[i].feeRate = rate
+			}
+		}
 		if txs[i].feeRate < sim.cfg.minimumFeeRate {
 			txs[i].feeRate = sim.cfg.minimumFeeRate
 		}
@@ -179,34 +388,81 @@ func (sim *simulator) genTransactions(currentHeight uint32, memPool *txPool) []*
 		if txs[i].size > maxBlockPayload {
 			txs[i].size = maxBlockPayload
 		}
+		if sim.cfg.chainTxFraction > 0 && memPool.Len() > 0 &&
+			sim.rnd.Float64() < sim.cfg.chainTxFraction {
+			sim.chainTx(txs[i], memPool)
+		}
+		if sim.cfg.expiryFraction > 0 &&
+			sim.rnd.Float64() < sim.cfg.expiryFraction {
+			txs[i].expiry = currentHeight + sim.cfg.expiryDelta
+		}
 		txs[i].fee = txs[i].feeRate * txs[i].size / 1000
-		txs[i].txHash[0] = byte(currentHeight >> 24)
-		txs[i].txHash[1] = byte(currentHeight >> 16)
-		txs[i].txHash[2] = byte(currentHeight >> 8)
-		txs[i].txHash[3] = byte(currentHeight)
-		txs[i].txHash[4] = byte(i >> 24)
-		txs[i].txHash[5] = byte(i >> 16)
-		txs[i].txHash[6] = byte(i >> 8)
-		txs[i].txHash[7] = byte(i)
+		txs[i].hidden = sim.hideTx(txs[i])
+		txs[i].setMsgTx(i)
 		heap.Push(memPool, txs[i])
+		sim.memPoolSize += uint64(txs[i].size)
 	}
 
 	return txs
 }
 
-// mineTransactions just mines txs up until the block is full
-func (sim *simulator) mineTransactions(currentHeight uint32, memPool *txPool) []*simTx {
-	sumSize := uint32(0)
+// walletFeeRate returns the fee rate a wallet following the estimator would
+// use for a new tx, using a random target confirmation. Estimates are queried
+// at most once per block for each target, as the estimator only significantly
+// changes when new blocks are processed. Returns false if the estimator could
+// not provide an estimate, in which case the wallet falls back to the fee rate
+// distribution.
+func (sim *simulator) walletFeeRate(currentHeight uint32) (uint32, bool) {
+	maxTarget := sim.cfg.estimatorMaxTarget
+	if maxTarget < 1 {
+		maxTarget = 1
+	}
+	target := 1 + int32(sim.rnd.Intn(int(maxTarget)))
+
+	est, cached := sim.estimateCache[target]
+	if !cached || est.height != currentHeight {
+		rate, err := sim.estimateFee(target)
+		est = cachedEstimate{height: currentHeight, rate: rate, err: err}
+		sim.estimateCache[target] = est
+	}
+
+	if est.err != nil {
+		sim.fallbackFeeTxs++
+		return 0, false
+	}
+	sim.estimatorFeeTxs++
+	return uint32(est.rate), true
+}
+
+// mineTransactions mines the stake transactions for the block at the current
+// height and then the regular txs from the mempool, according to the policy of
+// the given miner (the one selected to produce the block). Returns the mined
+// regular and stake transactions.
+func (sim *simulator) mineTransactions(currentHeight uint32, minerIdx int,
+	memPool *txPool) ([]*simTx, []*simTx) {
+
+	minedStake := sim.mineStakeTransactions(currentHeight)
+
+	policy := &sim.miners[minerIdx].policy
+	maxSize := policy.regularTxsSpace(totalTxsSizes(minedStake))
 	mined := make([]*simTx, 0)
+	sumSize := uint32(0)
 
-	for memPool.Len() > 0 {
-		tx := heap.Pop(memPool).(*simTx)
-		if sumSize+tx.size > maxBlockPayload {
-			heap.Push(memPool, tx)
-			break
+	emptyBlock := policy.emptyBlockRate > 0 &&
+		sim.rnd.Float64() < policy.emptyBlockRate
+	if !emptyBlock {
+		if policy.prioritySize > 0 {
+			mined, sumSize = sim.minePriorityArea(policy, maxSize,
+				currentHeight, memPool)
 		}
-		mined = append(mined, tx)
-		sumSize += tx.size
+		mined = append(mined, sim.mineByFeeRate(policy, maxSize, sumSize,
+			currentHeight, memPool)...)
+	}
+	sim.trackMinedBlock(minerIdx, mined, currentHeight)
+	sim.trackMinedAttackTxs(mined)
+	sim.memPoolSize -= uint64(totalTxsSizes(mined))
+
+	for _, tx := range mined {
 		if currentHeight-tx.genHeight > sim.longestMineDelay {
 			sim.longestMineDelay = currentHeight - tx.genHeight
 		}
@@ -217,7 +473,7 @@ func (sim *simulator) mineTransactions(currentHeight uint32, memPool *txPool) []
 	}
 	sim.totalBlockCount++
 
-	return mined
+	return mined, minedStake
 }
 
 func totalTxsSizes(txs []*simTx) uint32 {
@@ -228,8 +484,8 @@ func totalTxsSizes(txs []*simTx) uint32 {
 	return res
 }
 
-func (sim *simulator) trackHistograms(minedTxs []*simTx, newTxs []*simTx, currentHeight uint32) {
-	blockSize := totalTxsSizes(minedTxs)
+func (sim *simulator) trackHistograms(minedTxs, minedStxs, newTxs []*simTx, currentHeight uint32) {
+	blockSize := totalTxsSizes(minedTxs) + totalTxsSizes(minedStxs)
 	for h := 1; h < len(sim.histBlockSize); h++ {
 		if sim.histBlockSize[h].value > blockSize {
 			sim.histBlockSize[h-1].count++
@@ -272,7 +528,7 @@ func (sim *simulator) trackHistograms(minedTxs []*simTx, newTxs []*simTx, curren
 	}
 }
 
-func (sim *simulator) reportSimHistograms() {
+func (sim *simulator) reportSimHistograms(w io.Writer) {
 
 	countHistItems := func(items []*histItem) float64 {
 		res := float64(0)
@@ -291,7 +547,7 @@ func (sim *simulator) reportSimHistograms() {
 		l2 += fmt.Sprintf("%8d", h.count)
 		l3 += fmt.Sprintf("%8.2f", float64(h.count)/tot*100)
 	}
-	fmt.Printf("Block Size Histogram\n%s\n%s\n%s\n", l1, l2, l3)
+	fmt.Fprintf(w, "Block Size Histogram\n%s\n%s\n%s\n", l1, l2, l3)
 
 	l1 = ""
 	l2 = ""
@@ -302,7 +558,7 @@ func (sim *simulator) reportSimHistograms() {
 		l2 += fmt.Sprintf("%8d", h.count)
 		l3 += fmt.Sprintf("%8.2f", float64(h.count)/tot*100)
 	}
-	fmt.Printf("\nTx Size Histogram\n%s\n%s\n%s\n", l1, l2, l3)
+	fmt.Fprintf(w, "\nTx Size Histogram\n%s\n%s\n%s\n", l1, l2, l3)
 
 	l1 = ""
 	l2 = ""
@@ -313,7 +569,7 @@ func (sim *simulator) reportSimHistograms() {
 		l2 += fmt.Sprintf("%13d", h.count)
 		l3 += fmt.Sprintf("%13.2f", float64(h.count)/tot*100)
 	}
-	fmt.Printf("\nFee Rate Histogram\n%s\n%s\n%s\n", l1, l2, l3)
+	fmt.Fprintf(w, "\nFee Rate Histogram\n%s\n%s\n%s\n", l1, l2, l3)
 
 	l1 = ""
 	l2 = ""
@@ -324,7 +580,7 @@ func (sim *simulator) reportSimHistograms() {
 		l2 += fmt.Sprintf("%8d", h.count)
 		l3 += fmt.Sprintf("%8.2f", float64(h.count)/tot*100)
 	}
-	fmt.Printf("\nTx per block Histogram\n%s\n%s\n%s\n", l1, l2, l3)
+	fmt.Fprintf(w, "\nTx per block Histogram\n%s\n%s\n%s\n", l1, l2, l3)
 
 	l1 = ""
 	l2 = ""
@@ -335,21 +591,74 @@ func (sim *simulator) reportSimHistograms() {
 		l2 += fmt.Sprintf("%11d", h.count)
 		l3 += fmt.Sprintf("%11.2f", float64(h.count)/tot*100)
 	}
-	fmt.Printf("\nMining Interval Histogram\n%s\n%s\n%s\n", l1, l2, l3)
+	fmt.Fprintf(w, "\nMining Interval Histogram\n%s\n%s\n%s\n", l1, l2, l3)
 
-	fmt.Printf("\nBlock Counts\n")
-	fmt.Printf("  total = %d  w/ filled mempool = %d (%.2f%%)  longest mine "+
+	fmt.Fprintf(w, "\nBlock Counts\n")
+	fmt.Fprintf(w, "  total = %d  w/ filled mempool = %d (%.2f%%)  longest mine "+
 		"delay = %d\n",
 		sim.totalBlockCount, sim.mempoolFillCount, float64(sim.mempoolFillCount)*100.0/
 			float64(sim.totalBlockCount), sim.longestMineDelay)
 
-	fmt.Println("")
+	if sim.cfg.stake != (stakeConfig{}) {
+		fmt.Fprintln(w)
+		sim.reportStake(w)
+	}
+
+	if sim.cfg.expiryFraction > 0 || sim.cfg.maxTxAge > 0 ||
+		sim.cfg.maxMemPoolSize > 0 || sim.cfg.stake.ticketsPerWindow > 0 {
+		fmt.Fprintln(w)
+		sim.reportMemPoolRemovals(w)
+	}
+
+	if sim.cfg.chainTxFraction > 0 {
+		fmt.Fprintln(w)
+		sim.reportChains(w)
+	}
+
+	if len(sim.cfg.attackers) > 0 {
+		fmt.Fprintln(w)
+		sim.reportAttacks(w)
+	}
+
+	if sim.cfg.estimatorFeeFraction > 0 {
+		walletTxs := sim.estimatorFeeTxs + sim.fallbackFeeTxs
+		fmt.Fprintf(w, "\nWallet Feedback\n")
+		fmt.Fprintf(w, "  txs using estimator = %d  using estimated fee = %d "+
+			"(%.2f%%)  fallback to distribution = %d\n", walletTxs,
+			sim.estimatorFeeTxs, float64(sim.estimatorFeeTxs)*100.0/
+				float64(walletTxs), sim.fallbackFeeTxs)
+	}
+
+	fmt.Fprintln(w)
 }
 
-func simTxHashes(txs []*simTx) []*chainhash.Hash {
-	res := make([]*chainhash.Hash, len(txs))
-	for i := 0; i < len(res); i++ {
-		res[i] = &txs[i].txHash
+// newSimBlock creates the block mined at the given height with the provided
+// regular and stake transactions, as it would be received by a full node.
+func newSimBlock(height uint32, txs, stxs []*simTx) *dcrutil.Block {
+	msgBlock := &wire.MsgBlock{
+		Transactions:  make([]*wire.MsgTx, 0, len(txs)+1),
+		STransactions: make([]*wire.MsgTx, 0, len(stxs)),
 	}
-	return res
+	msgBlock.Header.Height = height
+
+	coinbase := &simTx{txType: txTypeCoinbase, genHeight: height}
+	coinbase.setMsgTx(0)
+	msgBlock.Transactions = append(msgBlock.Transactions, coinbase.msgTx)
+	for _, tx := range txs {
+		msgBlock.Transactions = append(msgBlock.Transactions, tx.msgTx)
+	}
+
+	for _, tx := range stxs {
+		switch tx.txType {
+		case txTypeVote:
+			msgBlock.Header.Voters++
+		case txTypeTicket:
+			msgBlock.Header.FreshStake++
+		case txTypeRevocation:
+			msgBlock.Header.Revocations++
+		}
+		msgBlock.STransactions = append(msgBlock.STransactions, tx.msgTx)
+	}
+
+	return dcrutil.NewBlock(msgBlock)
 }
@@ -0,0 +1,144 @@
+// Snapshot module. This provides a structured copy of the internal state of the
+// estimator, which can be rendered as text (for humans) or JSON (for tools).
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// ConfirmRangeSnapshot holds the statistics of the txs of a fee rate bucket
+// in a confirmation range. The counts are decayed, so they are not integers.
+type ConfirmRangeSnapshot struct {
+	// TxCount is the number of txs in the range
+	TxCount float64 `json:"txCount"`
+
+	// AvgFeeRate is the average fee rate (in atoms/KB) of the txs in the
+	// range, or zero if there are none
+	AvgFeeRate float64 `json:"avgFeeRate"`
+}
+
+// BucketSnapshot holds the statistics of a fee rate bucket.
+type BucketSnapshot struct {
+	// UpperBound is the (inclusive) upper bound of the fee rates (in atoms/KB)
+	// of the bucket. The last bucket has an upper bound of +Inf, which is
+	// encoded as null in JSON.
+	UpperBound float64 `json:"upperBound"`
+
+	// ConfirmCount is the number of mined txs of the bucket and AvgFeeRate
+	// their average fee rate (in atoms/KB)
+	ConfirmCount float64 `json:"confirmCount"`
+	AvgFeeRate   float64 `json:"avgFeeRate"`
+
+	// Confirmed holds, at index i, the mined txs confirmed within
+	// ConfirmRanges[i] blocks of the snapshot (the last range holds every
+	// mined tx)
+	Confirmed []ConfirmRangeSnapshot `json:"confirmed"`
+
+	// MemPool holds, at index i, the txs that have been in the mempool for at
+	// least ConfirmRanges[i-1] (zero for the first range) and less than
+	// ConfirmRanges[i] blocks, ie, the ones that would fall into range i if
+	// mined on the next block (the last range holds the txs that have been
+	// there for longer)
+	MemPool []ConfirmRangeSnapshot `json:"memPool"`
+}
+
+// MarshalJSON encodes the bucket as JSON, using null for an infinite upper
+// bound (which is not valid JSON).
+func (b BucketSnapshot) MarshalJSON() ([]byte, error) {
+	type bucket BucketSnapshot
+	aux := struct {
+		bucket
+		UpperBound *float64 `json:"upperBound"`
+	}{bucket: bucket(b)}
+	if !math.IsInf(b.UpperBound, 1) {
+		aux.UpperBound = &b.UpperBound
+	}
+	return json.Marshal(aux)
+}
+
+// EstimatorSnapshot is a copy of the internal state of an estimator.
+type EstimatorSnapshot struct {
+	BestHeight  int64   `json:"bestHeight"`
+	MaxConfirms int32   `json:"maxConfirms"`
+	Decay       float64 `json:"decay"`
+
+	// ConfirmRanges are the upper bounds (in blocks) of the confirmation
+	// ranges, except for the last (+Inf) one
+	ConfirmRanges []int32 `json:"confirmRanges"`
+
+	// MemPoolTxs is the number of mempool txs tracked by the estimator
+	MemPoolTxs int `json:"memPoolTxs"`
+
+	Buckets []BucketSnapshot `json:"buckets"`
+}
+
+// newConfirmRangeSnapshots returns the snapshots of the given confirmation
+// ranges, whose tx counts are recorded divided by the given scale.
+func newConfirmRangeSnapshots(counts []txConfirmStatBucketCount, scale float64) []ConfirmRangeSnapshot {
+	res := make([]ConfirmRangeSnapshot, len(counts))
+	for c, count := range counts {
+		res[c].TxCount = count.txCount * scale
+		if count.txCount > 0 {
+			res[c].AvgFeeRate = count.feeSum / count.txCount
+		}
+	}
+	return res
+}
+
+// Snapshot returns a copy of the current internal state of the estimator.
+func (stats *FeeEstimator) Snapshot() *EstimatorSnapshot {
+
+	// TODO: add lock
+
+	res := &EstimatorSnapshot{
+		BestHeight:    stats.bestHeight,
+		MaxConfirms:   stats.maxConfirms,
+		Decay:         stats.decay,
+		ConfirmRanges: append([]int32(nil), stats.confirmBounds...),
+		MemPoolTxs:    len(stats.memPoolTxs),
+		Buckets:       make([]BucketSnapshot, len(stats.bucketFeeBounds)),
+	}
+	for b := range res.Buckets {
+		bucket := &stats.buckets[b]
+		res.Buckets[b] = BucketSnapshot{
+			UpperBound:   float64(stats.bucketFeeBounds[b]),
+			ConfirmCount: bucket.confirmCount * stats.decayScale,
+			Confirmed: newConfirmRangeSnapshots(bucket.confirmed,
+				stats.decayScale),
+			MemPool: newConfirmRangeSnapshots(stats.memPool[b].confirmed, 1),
+		}
+		if bucket.confirmCount > 0 {
+			res.Buckets[b].AvgFeeRate = bucket.feeSum / bucket.confirmCount
+		}
+	}
+	return res
+}
+
+// Text renders the mined txs of the snapshot as a table, with a line per fee
+// rate bucket and the average fee rate (in DCR/KB) and count of the txs of each
+// confirmation range.
+func (s *EstimatorSnapshot) Text() string {
+	res := "          |"
+	for _, c := range s.ConfirmRanges {
+		res += fmt.Sprintf("   %14d|", c)
+	}
+	res += fmt.Sprintf("   %14s", "+Inf")
+	res += "\n"
+
+	for _, bucket := range s.Buckets {
+		res += fmt.Sprintf("%10.8f", bucket.UpperBound/1e8)
+		for _, conf := range bucket.Confirmed {
+			res += fmt.Sprintf("| %.8f %5.0f", conf.AvgFeeRate/1e8, conf.TxCount)
+		}
+		res += "\n"
+	}
+
+	return res
+}
+
+// JSON renders the snapshot as indented JSON.
+func (s *EstimatorSnapshot) JSON() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
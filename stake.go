@@ -0,0 +1,224 @@
+// Stake module. This generates the stake transactions (votes, ticket purchases
+// and revocations) of the simulated network and selects which of them get
+// included in new blocks.
+//
+// Stake transactions are mined in their own tree of the block but still use
+// block space, so they reduce the space available for regular transactions.
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+
+	"github.com/decred/dcrd/chaincfg"
+)
+
+const (
+	// voteSize, ticketSize and revocationSize are the sizes (in bytes) of
+	// typical stake transactions
+	voteSize       = 421
+	ticketSize     = 298
+	revocationSize = 296
+)
+
+var (
+	ticketsPerBlock       = uint32(chaincfg.MainNetParams.TicketsPerBlock)
+	stakeDiffWindowSize   = uint32(chaincfg.MainNetParams.StakeDiffWindowSize)
+	maxFreshStakePerBlock = int(chaincfg.MainNetParams.MaxFreshStakePerBlock)
+)
+
+// stakeConfig configures the stake transactions generated by the simulator.
+// Votes are always generated. The zero value of the config does not generate
+// any ticket purchases or revocations.
+type stakeConfig struct {
+	// ticketsPerWindow is the average number of tickets purchased during each
+	// ticket price window
+	ticketsPerWindow float64
+
+	// surgeFraction is the fraction of the tickets of a window purchased right
+	// after the ticket price changes. The rest are spread over the window.
+	surgeFraction float64
+
+	// ticketFeeRate is the minimum fee rate (in atoms/KB) paid by tickets
+	ticketFeeRate uint32
+
+	// ticketFeeRateCoef is the coefficient for the distribution of fee rates
+	// paid by tickets (above ticketFeeRate)
+	ticketFeeRateCoef float64
+
+	// missedVoteRate is the fraction of tickets called to vote that miss their
+	// vote. Missed tickets are revoked on the following block.
+	missedVoteRate float64
+}
+
+// stakeStats tracks the stake transactions generated and mined by the
+// simulator.
+type stakeStats struct {
+	votes             int
+	missedVotes       int
+	ticketsGenerated  int
+	ticketsMined      int
+	ticketsRemoved    int
+	revocations       int
+	surgeBlocks       int
+	surgeBlockTickets int
+	fullStakeBlocks   int
+}
+
+// stakeWindowStart returns whether the block at the given height is the first
+// one of a new ticket price window.
+func stakeWindowStart(height uint32) bool {
+	return height%stakeDiffWindowSize == 0
+}
+
+// newStakeTx returns a new stake transaction generated at the given height.
+func newStakeTx(txType simTxType, size, feeRate, height uint32, idx int) *simTx {
+	tx := &simTx{
+		txType:    txType,
+		size:      size,
+		feeRate:   feeRate,
+		fee:       feeRate * size / 1000,
+		genHeight: height,
+	}
+	tx.setMsgTx(idx)
+	return tx
+}
+
+// genStakeTransactions generates the stake transactions that appear in the
+// network after the block at currentHeight has been mined: the votes on that
+// block, revocations for the tickets that missed their votes on it and new
+// ticket purchases.
+func (sim *simulator) genStakeTransactions(currentHeight uint32) []*simTx {
+	cfg := &sim.cfg.stake
+	stxs := make([]*simTx, 0, ticketsPerBlock)
+
+	missed := 0
+	for i := uint32(0); i < ticketsPerBlock; i++ {
+		if cfg.missedVoteRate > 0 && sim.rnd.Float64() < cfg.missedVoteRate {
+			missed++
+			continue
+		}
+		vote := newStakeTx(txTypeVote, voteSize, 0, currentHeight, len(stxs))
+		sim.pendingVotes = append(sim.pendingVotes, vote)
+		stxs = append(stxs, vote)
+	}
+	sim.stakeStats.missedVotes += missed
+
+	for i := 0; i < missed; i++ {
+		revocation := newStakeTx(txTypeRevocation, revocationSize, 0,
+			currentHeight, len(stxs))
+		sim.pendingRevocations = append(sim.pendingRevocations, revocation)
+		stxs = append(stxs, revocation)
+	}
+
+	if cfg.ticketsPerWindow <= 0 {
+		return stxs
+	}
+
+	// Tickets are purchased for the window of the next block. Most buyers wait
+	// until the price changes, so there is a surge of purchases right after
+	// the start of the window.
+	nextHeight := currentHeight + 1
+	window := nextHeight / stakeDiffWindowSize
+	spreadRate := cfg.ticketsPerWindow * (1 - cfg.surgeFraction) /
+		float64(stakeDiffWindowSize)
+	nbTickets := int(sim.rnd.ExpFloat64() * spreadRate)
+	if stakeWindowStart(nextHeight) {
+		nbTickets += int(cfg.ticketsPerWindow * cfg.surgeFraction)
+	}
+	for i := 0; i < nbTickets; i++ {
+		rate := cfg.ticketFeeRate
+		if cfg.ticketFeeRateCoef > 0 {
+			rate += uint32(sim.rnd.ExpFloat64() * cfg.ticketFeeRateCoef)
+		}
+		ticket := newStakeTx(txTypeTicket, ticketSize, rate, currentHeight,
+			len(stxs))
+
+		// tickets pay the price of the current window, so they can't be
+		// mined once the window ends
+		ticket.expiry = (window + 1) * stakeDiffWindowSize
+		heap.Push(&sim.ticketPool, ticket)
+		stxs = append(stxs, ticket)
+	}
+	sim.stakeStats.ticketsGenerated += nbTickets
+
+	return stxs
+}
+
+// pruneTicketPool removes the tickets that can't be mined anymore at the given
+// height because the ticket price has changed.
+func (sim *simulator) pruneTicketPool(currentHeight uint32) []*simTx {
+	if !stakeWindowStart(currentHeight) || sim.ticketPool.Len() == 0 {
+		return nil
+	}
+
+	var removed []*simTx
+	sim.ticketPool.removeWhere(func(tx *simTx) bool {
+		if !tx.isExpired(currentHeight) {
+			return false
+		}
+		sim.removals[removalStakeDiff].add(tx, currentHeight)
+		removed = append(removed, tx)
+		return true
+	})
+	sim.stakeStats.ticketsRemoved += len(removed)
+
+	return removed
+}
+
+// mineStakeTransactions selects the stake transactions for the block at the
+// given height: all votes on the previous block, all pending revocations and
+// the tickets paying the highest fee rates, up to the maximum number of
+// tickets per block.
+func (sim *simulator) mineStakeTransactions(currentHeight uint32) []*simTx {
+	mined := make([]*simTx, 0, len(sim.pendingVotes)+
+		len(sim.pendingRevocations)+maxFreshStakePerBlock)
+
+	mined = append(mined, sim.pendingVotes...)
+	sim.stakeStats.votes += len(sim.pendingVotes)
+	sim.pendingVotes = sim.pendingVotes[:0]
+
+	mined = append(mined, sim.pendingRevocations...)
+	sim.stakeStats.revocations += len(sim.pendingRevocations)
+	sim.pendingRevocations = sim.pendingRevocations[:0]
+
+	tickets := 0
+	for tickets < maxFreshStakePerBlock && sim.ticketPool.Len() > 0 {
+		mined = append(mined, heap.Pop(&sim.ticketPool).(*simTx))
+		tickets++
+	}
+	sim.stakeStats.ticketsMined += tickets
+	if tickets == maxFreshStakePerBlock {
+		sim.stakeStats.fullStakeBlocks++
+	}
+	if stakeWindowStart(currentHeight) {
+		sim.stakeStats.surgeBlocks++
+		sim.stakeStats.surgeBlockTickets += tickets
+	}
+
+	return mined
+}
+
+// reportStake prints the stats of the simulated stake transactions.
+func (sim *simulator) reportStake(w io.Writer) {
+	stats := &sim.stakeStats
+	blocks := float64(sim.totalBlockCount)
+	surgeBlocks := float64(stats.surgeBlocks)
+	if surgeBlocks == 0 {
+		surgeBlocks = 1
+	}
+
+	fmt.Fprintf(w, "Stake Transactions\n")
+	fmt.Fprintf(w, "  votes = %d (%.2f/block)  missed = %d  revocations = %d\n",
+		stats.votes, float64(stats.votes)/blocks, stats.missedVotes,
+		stats.revocations)
+	fmt.Fprintf(w, "  tickets generated = %d  mined = %d (%.2f/block)  removed "+
+		"on price change = %d\n", stats.ticketsGenerated,
+		stats.ticketsMined, float64(stats.ticketsMined)/blocks,
+		stats.ticketsRemoved)
+	fmt.Fprintf(w, "  blocks with %d tickets = %d (%.2f%%)  avg tickets on first "+
+		"block of window = %.2f\n", maxFreshStakePerBlock,
+		stats.fullStakeBlocks, float64(stats.fullStakeBlocks)*100/blocks,
+		float64(stats.surgeBlockTickets)/surgeBlocks)
+}
@@ -0,0 +1,120 @@
+// Tx chains module. This creates chains of dependent transactions, where a
+// child tx spends an output of an unconfirmed parent and therefore can't be
+// mined before it.
+//
+// Miners select txs by their ancestor fee rate (the lowest of the fee rate of
+// the tx itself and the fee rate of the package formed by it and its
+// unconfirmed ancestors), so a child paying a high fee rate can pull its
+// parent into a block (child pays for parent).
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+)
+
+// chainStats tracks the chained transactions generated and mined by the
+// simulator.
+type chainStats struct {
+	chainedTxs      int
+	cpfpTxs         int
+	packagesMined   int
+	ancestorsPulled int
+}
+
+// miningRate returns the fee rate (in atoms/KB) miners use to sort the tx: the
+// lowest of its own fee rate and the fee rate of the package formed by it and
+// its unconfirmed ancestors.
+func (tx *simTx) miningRate() uint32 {
+	if tx.ancestorSize == 0 {
+		return tx.feeRate
+	}
+	pkgRate := uint32((uint64(tx.fee) + uint64(tx.ancestorFee)) * 1000 /
+		(uint64(tx.size) + uint64(tx.ancestorSize)))
+	if pkgRate < tx.feeRate {
+		return pkgRate
+	}
+	return tx.feeRate
+}
+
+// unminedAncestors returns the unconfirmed ancestors of the tx, starting at the
+// oldest one.
+func (tx *simTx) unminedAncestors() []*simTx {
+	res := make([]*simTx, tx.ancestorCount)
+	i := len(res) - 1
+	for p := tx.parent; p != nil; p = p.parent {
+		res[i] = p
+		i--
+	}
+	return res
+}
+
+// descendantsInPool returns all descendants of the tx which are still in the
+// mempool.
+func (tx *simTx) descendantsInPool() []*simTx {
+	var res []*simTx
+	for _, c := range tx.children {
+		if c.heapIdx < 0 {
+			continue
+		}
+		res = append(res, c)
+		res = append(res, c.descendantsInPool()...)
+	}
+	return res
+}
+
+// chainTx makes the new tx spend an output of a random tx of the mempool,
+// unless that would exceed the maximum chain depth. Some of the chained txs are
+// used to bump the fee of their ancestors.
+func (sim *simulator) chainTx(tx *simTx, memPool *txPool) {
+	parent := (*memPool)[sim.rnd.Intn(memPool.Len())]
+	if parent.ancestorCount+1 > sim.cfg.maxChainDepth {
+		return
+	}
+
+	tx.parent = parent
+	tx.ancestorFee = parent.ancestorFee + parent.fee
+	tx.ancestorSize = parent.ancestorSize + parent.size
+	tx.ancestorCount = parent.ancestorCount + 1
+	parent.children = append(parent.children, tx)
+	sim.chainStats.chainedTxs++
+
+	if sim.cfg.cpfpFraction > 0 && sim.rnd.Float64() < sim.cfg.cpfpFraction {
+		tx.feeRate = uint32(float64(tx.feeRate) * sim.cfg.cpfpFeeRateMult)
+		sim.chainStats.cpfpTxs++
+	}
+}
+
+// txMined marks the tx as mined at the given height and updates the ancestor
+// info of its descendants, which don't need to be mined along with it anymore.
+func (sim *simulator) txMined(tx *simTx, currentHeight uint32, memPool *txPool) {
+	tx.minedHeight = currentHeight
+
+	var update func(d *simTx)
+	update = func(d *simTx) {
+		d.ancestorFee -= tx.fee
+		d.ancestorSize -= tx.size
+		d.ancestorCount--
+		if d.heapIdx >= 0 {
+			heap.Fix(memPool, d.heapIdx)
+		}
+		for _, c := range d.children {
+			update(c)
+		}
+	}
+	for _, c := range tx.children {
+		c.parent = nil
+		update(c)
+	}
+	tx.children = nil
+}
+
+// reportChains prints the stats of the chained transactions.
+func (sim *simulator) reportChains(w io.Writer) {
+	stats := &sim.chainStats
+	fmt.Fprintf(w, "Tx Chains\n")
+	fmt.Fprintf(w, "  chained txs = %d  cpfp txs = %d  packages mined = %d  "+
+		"ancestors pulled by packages = %d\n", stats.chainedTxs,
+		stats.cpfpTxs, stats.packagesMined, stats.ancestorsPulled)
+}